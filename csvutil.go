@@ -1,249 +1,3313 @@
-package csvutil
-
-import (
-	"encoding/csv"
-	"fmt"
-	"os"
-	"reflect"
-	"strconv"
-)
-
-//	 Tags to read on struct will be in the form of `col:"1"` being "1" is the column number in the csv file
-//	 eg.
-//		type Test struct {
-//		    Field1 string `col:"column name"`
-//		}
-func ReadToStruct[T any](filename string) ([]T, error) {
-	records, err := readFileToArr(filename)
-	if err != nil {
-		return nil, fmt.Errorf("read file error %s", err)
-	}
-
-	str := []T{}
-	convToInterface, err := readColumnDefCreateStruct[T](records[0])
-	if err != nil {
-		return nil, err
-	}
-
-	for i, r := range records {
-		if i == 0 {
-			continue
-		}
-		if elem, err := convToInterface(r); err != nil {
-			return nil, err
-		} else {
-			str = append(str, *elem)
-		}
-	}
-
-	return str, nil
-}
-
-// Write to CSV using tag from stuct
-// eg.
-//
-//	type Test struct {
-//	   Field1 string `col:"column name"`
-//	}
-//
-// will become
-// | column name  |
-// | field1 value |
-func WriteFromStruct[T any](filename string, in []T) error {
-	out := [][]string{}
-	header, err := getStructTagForHeader[T]()
-	if err != nil {
-		return err
-	}
-	headRow := make([]string, len(header))
-	for i, v := range header {
-		headRow[i] = v
-	}
-
-	out = append(out, headRow)
-	for _, r := range in {
-		row := make([]string, len(headRow))
-		str := reflect.ValueOf(r)
-
-		for i := range header {
-			field := str.Field(i)
-			switch field.Kind() {
-			case reflect.Invalid:
-				err := fmt.Errorf("field type not supported %s", field.Kind())
-				return err
-			case reflect.Bool:
-				row[i] = strconv.FormatBool(field.Bool())
-				break
-			case reflect.Int32:
-				fallthrough
-			case reflect.Int8:
-				fallthrough
-			case reflect.Int16:
-				fallthrough
-			case reflect.Int64:
-				fallthrough
-			case reflect.Int:
-				row[i] = strconv.FormatInt(field.Int(), 10)
-				break
-			case reflect.Float32:
-				row[i] = strconv.FormatFloat(field.Float(), 'f', 0, 32)
-				break
-			case reflect.Float64:
-				row[i] = strconv.FormatFloat(field.Float(), 'f', 0, 64)
-				break
-			case reflect.String:
-				row[i] = field.String()
-				break
-			default:
-				return fmt.Errorf("unsupport type %s", field.Kind())
-
-			}
-		}
-
-		out = append(out, row)
-	}
-
-	wf, err := os.Create(filename)
-	if err != nil {
-		fmt.Println("Unable to write file", err)
-		return err
-	}
-
-	csvWriter := csv.NewWriter(wf)
-	if err = csvWriter.WriteAll(out); err != nil {
-		fmt.Println("write error", err)
-		return err
-	}
-
-	return nil
-}
-
-func readFileToArr(filename string) (rows [][]string, err error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read file %s", err)
-	}
-	defer f.Close()
-
-	csvReader := csv.NewReader(f)
-	records, err := csvReader.ReadAll()
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse file as CSV %s", err)
-	}
-
-	return records, nil
-}
-
-func readColumnDefCreateStruct[T any](colHeader []string) (func(row []string) (*T, error), error) {
-	elem := reflect.TypeOf(new(T)).Elem()
-	if elem.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("%s is not struct", elem)
-	}
-	colDef, outErr := getStructTags(elem, colHeader)
-	if outErr != nil {
-		return nil, fmt.Errorf("error during reading column tag %s", outErr)
-	}
-
-	return func(row []string) (*T, error) {
-		t := new(T)
-		str := reflect.ValueOf(t).Elem()
-		for k, v := range colDef {
-			switch field := str.FieldByName(k); field.Kind() {
-			case reflect.Invalid:
-				err := fmt.Errorf("field type not supported %s", k)
-				return nil, err
-			case reflect.Bool:
-				out, err := strconv.ParseBool(row[v])
-				if err != nil {
-					err = fmt.Errorf("field bool %s invalid: %s", k, err)
-					return nil, err
-				}
-				field.SetBool(out)
-				break
-			case reflect.Int32:
-				fallthrough
-			case reflect.Int8:
-				fallthrough
-			case reflect.Int16:
-				fallthrough
-			case reflect.Int64:
-				fallthrough
-			case reflect.Int:
-				out, err := strconv.ParseInt(row[v], 10, 32)
-				if err != nil {
-					err = fmt.Errorf("field int %s invalid: %s", k, err)
-					return nil, err
-				}
-				field.SetInt(out)
-				break
-			case reflect.Float32:
-				out, err := strconv.ParseFloat(row[v], 32)
-				if err != nil {
-					err = fmt.Errorf("field bool %s invalid: %s", k, err)
-					return nil, err
-				}
-				field.SetFloat(out)
-				break
-			case reflect.Float64:
-				out, err := strconv.ParseFloat(row[v], 64)
-				if err != nil {
-					err = fmt.Errorf("field bool %s invalid: %s", k, err)
-					return nil, err
-				}
-				field.SetFloat(out)
-				break
-			case reflect.String:
-				field.SetString(row[v])
-				break
-			default:
-				return nil, fmt.Errorf("unsupport type %s", k)
-			}
-		}
-
-		res := str.Interface().(T)
-		return &res, nil
-	}, nil
-}
-
-func getStructTags(T reflect.Type, colHeader []string) (map[string]int, error) {
-	if T.Kind() != reflect.Struct && T.Kind() != reflect.Interface {
-		return nil, fmt.Errorf("%s is not a struct", T)
-	}
-
-	colNum := map[string]int{}
-	for i, v := range colHeader {
-		colNum[v] = i
-	}
-
-	m := make(map[string]int)
-	for i := 0; i < T.NumField(); i++ {
-		fld := T.Field(i)
-		if col := fld.Tag.Get("col"); col != "" {
-			if n, ok := colNum[col]; !ok {
-				return nil, fmt.Errorf("column %s does not exist", col)
-			} else {
-				m[fld.Name] = n
-			}
-		}
-	}
-	return m, nil
-}
-
-func getStructTagForHeader[T any]() (map[int]string, error) {
-	elem := reflect.TypeOf(new(T)).Elem()
-	if elem.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("%s is not struct", elem)
-	}
-
-	if elem.Kind() != reflect.Struct && elem.Kind() != reflect.Interface {
-		return nil, fmt.Errorf("%s is not a struct", elem)
-	}
-	out := map[int]string{}
-	for i := 0; i < elem.NumField(); i++ {
-		fld := elem.Field(i)
-		if col := fld.Tag.Get("col"); col != "" {
-			out[i] = col
-		}
-	}
-	return out, nil
-}
+package csvutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	encunicode "golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+//	 Tags to read on struct will be in the form of `col:"1"` being "1" is the column number in the csv file
+//	 eg.
+//		type Test struct {
+//		    Field1 string `col:"column name"`
+//		}
+//
+//	 A preserve tag keeps a numeric looking column such as a long ID a string
+//	 for type inference, see Options.TypeConsistencyCheck
+//	 eg.
+//		type Test struct {
+//		    Field1 string `col:"account" preserve:"true"`
+//		}
+//
+//	 A numeric tag is the column number counted from 1 unless a header has that
+//	 exact name, so files with meaningless header text can be mapped by position
+//	 eg.
+//		type Test struct {
+//		    Field1 string `col:"1"`
+//		    Field2 int    `col:"amount"`
+//		}
+//
+//	 Tagged fields of a struct embedded by value are read and written as if they
+//	 were declared in place. Like encoding/json a field of the same name nearer
+//	 the top hides the embedded one, and structs embedded by pointer are skipped
+//	 eg.
+//		type Audit struct {
+//		    CreatedBy string `col:"created_by"`
+//		}
+//		type Test struct {
+//		    Field1 string `col:"column name"`
+//		    Audit
+//		}
+//
+//	 Tags are compared with the header after CSV unquoting, so the quoted header
+//	 "Revenue, USD" is matched by `col:"Revenue, USD"`
+//
+//	 String fields may restrict their values with an enum tag
+//	 eg.
+//		type Color string
+//		type Test struct {
+//		    Field1 Color `col:"color" enum:"Red,Green,Blue"`
+//		}
+//
+//	 A value outside the enum, or the true and false tags of a bool, is an
+//	 error unless the field has an unknown tag holding the value to use
+//	 eg.
+//		type Test struct {
+//		    Field1 string `col:"status" enum:"active,closed,other" unknown:"other"`
+//		}
+//
+//	 An intern tag keeps one copy of each distinct value of a string column with
+//	 few of them, such as a country code, shared by every row holding it. See
+//	 Options.InternStrings to intern every string column
+//	 eg.
+//		type Test struct {
+//		    Field1 string `col:"country" intern:"true"`
+//		}
+//
+//	 Int fields may be bounded with min and max tags, out of range values are an
+//	 error unless clamp is set in which case they are moved to the nearest bound
+//	 eg.
+//		type Test struct {
+//		    Field1 int `col:"score" min:"0" max:"100" clamp:"true"`
+//		}
+//
+//	 A suffix tag strips a unit from the cell before parsing, several units may be
+//	 listed and the first one is appended again by WriteFromStruct
+//	 eg.
+//		type Test struct {
+//		    Field1 int `col:"latency" suffix:"ms"`
+//		}
+//
+//	 A json tag decodes the cell as JSON into the field, an empty cell is the zero
+//	 value, eg. a nil slice. WriteFromStruct encodes the field back to JSON
+//	 eg.
+//		type Item struct {
+//		    K int `json:"k"`
+//		}
+//		type Test struct {
+//		    Field1 map[string]any `col:"metadata" json:"true"`
+//		    Field2 []Item         `col:"items" json:"true"`
+//		}
+//
+//	 A group tag on an int field is the thousands separator, stripped before
+//	 parsing and inserted by WriteFromStruct
+//	 eg.
+//		type Test struct {
+//		    Field1 int `col:"population" group:","`
+//		}
+//
+//	 A field tagged required must have its cell present in every row, see
+//	 Options.PadShortRows
+//	 eg.
+//		type Test struct {
+//		    Field1 string `col:"id" required:"true"`
+//		}
+//
+//	 time.Time fields are parsed with the layout in the time tag, RFC3339 when
+//	 absent, and an empty cell is the zero time. A tz tag, eg. "Local" or
+//	 "America/New_York", is the location of cells without a zone and the
+//	 location WriteFromStruct formats in
+//	 eg.
+//		type Test struct {
+//		    Field1 time.Time `col:"created" time:"2006-01-02 15:04:05" tz:"America/New_York"`
+//		}
+//
+//	 Several layouts may be separated by "|", they are tried from the longest to
+//	 the shortest so a date and time is used when present and a date alone is
+//	 midnight. WriteFromStruct uses the first layout
+//	 eg.
+//		type Test struct {
+//		    Field1 time.Time `col:"when" time:"2006-01-02|2006-01-02 15:04:05"`
+//		}
+//
+//	 A []string field tagged with "..." before a column name takes every cell
+//	 from that column to the end of the row, rows may then differ in width.
+//	 WriteFromStruct writes the cells back at the end of the row so it should be
+//	 the last tagged field
+//	 eg.
+//		type Test struct {
+//		    Field1 string   `col:"id"`
+//		    Field2 []string `col:"...values"`
+//		}
+//
+//	 A [][]string field tagged nested holds a whole CSV in one cell, each inner
+//	 row on its own line
+//	 eg.
+//		type Test struct {
+//		    Field1 [][]string `col:"matrix" nested:"true"`
+//		}
+//
+//	 Slice fields are split by the sep tag and each element parsed by its type
+//	 eg.
+//		type Test struct {
+//		    Field1 []int `col:"scores" sep:","`
+//		}
+//
+//	 Map fields may instead hold key=value pairs separated by the sep tag, the kv
+//	 tag changes the "=" between key and value
+//	 eg.
+//		type Attributes map[string]string
+//		type Test struct {
+//		    Field1 Attributes `col:"attrs" sep:";"`
+//		}
+//
+//	 Bool fields may list the exact cell values meaning true and false, anything
+//	 else is an error. WriteFromStruct writes the first value of each list
+//	 eg.
+//		type Test struct {
+//		    Field1 bool `col:"subscribed" true:"opt-in" false:"opt-out"`
+//		}
+//
+//	 With boolmode presence a bool is true when its cell is not empty, it is
+//	 written as "1" or the true tag and false as an empty cell
+//	 eg.
+//		type Test struct {
+//		    Field1 bool `col:"flagged" boolmode:"presence" true:"x"`
+//		}
+//
+//	 With boolmode mark a check mark such as "✓" or "X" is true and a blank cell
+//	 is false, anything else is an error
+//
+//	 Float fields stored as fixed point integers take a scale tag, the cell is
+//	 divided by it on read and WriteFromStruct multiplies it back
+//	 eg.
+//		type Test struct {
+//		    Field1 float64 `col:"temperature" scale:"100"`
+//		}
+//
+//	 A round tag rounds the value read to that many decimals, eg. after scaling
+//	 eg.
+//		type Test struct {
+//		    Field1 float64 `col:"price" scale:"100" round:"2"`
+//		}
+//
+//	 Pointer fields are left nil for an empty cell so "0" and missing differ,
+//	 WriteFromStruct writes nil as an empty cell
+//	 eg.
+//		type Test struct {
+//		    Field1 *int `col:"quantity"`
+//		}
+//
+//	 With the bool tags this gives a tri-state "1", "0" or empty that
+//	 WriteFromStruct writes back the same way
+//	 eg.
+//		type Test struct {
+//		    Field1 *bool `col:"verified" true:"1" false:"0"`
+//		}
+//
+//	 A string field may be read from several columns with a cols tag, the cells
+//	 are joined by the join tag. WriteFromStruct does not split it back
+//	 eg.
+//		type Test struct {
+//		    Field1 string `cols:"area_code,number" join:"-"`
+//		}
+//
+//	 Alternatives separated by | are tried in order, eg. column 3 when the
+//	 header is that wide, else the column named amount
+//	 eg.
+//		type Test struct {
+//		    Field1 float64 `col:"3|amount"`
+//		}
+//
+//	 A string field tagged @raw gets the whole row joined back with the
+//	 delimiter, eg. for an audit trail. It is not written by WriteFromStruct
+//	 eg.
+//		type Test struct {
+//		    Source string `col:"@raw"`
+//		}
+//
+//	 A string field tagged @hash: gets a stable hex hash of the listed cells,
+//	 eg. as a key for deduplication. It is not written by WriteFromStruct
+//	 eg.
+//		type Test struct {
+//		    Key string `col:"@hash:name,dob"`
+//		}
+func ReadToStruct[T any](filename string) ([]T, error) {
+	return ReadToStructWithOptions[T](filename, Options{})
+}
+
+// Same as ReadToStruct but parsing is controlled by opts
+func ReadToStructWithOptions[T any](filename string, opts Options) ([]T, error) {
+	f, err := openWithRetry(filename, opts)
+	if err != nil {
+		return nil, fmt.Errorf("read file error unable to read file %w", err)
+	}
+	defer f.Close()
+
+	str, err := DecodeFromReaderWithOptions[T](f, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.SourceColumn != "" {
+		if err := setSource(str, opts.SourceColumn, filename); err != nil {
+			return nil, err
+		}
+	}
+	return str, nil
+}
+
+// Same as ReadToStruct but the read gives up with ctx.Err() once ctx is
+// cancelled or its deadline passes, both while reading the file and between
+// rows while converting
+func ReadToStructContext[T any](ctx context.Context, filename string) ([]T, error) {
+	f, err := openWithRetry(filename, Options{})
+	if err != nil {
+		return nil, fmt.Errorf("read file error unable to read file %w", err)
+	}
+	defer f.Close()
+
+	st := newReadState[T]()
+	records, err := readToArr(ctxReader{ctx: ctx, r: f}, Options{}, st)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("read file error %w", err)
+	}
+
+	return recordsToStruct[T](ctx, records, Options{}, st)
+}
+
+// ctxReader fails reads with ctx.Err() once ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Same as ReadToStruct but the CSV is read from r, eg. an HTTP request body
+func DecodeFromReader[T any](r io.Reader) ([]T, error) {
+	return DecodeFromReaderWithOptions[T](r, Options{})
+}
+
+// Same as DecodeFromReader but parsing is controlled by opts
+func DecodeFromReaderWithOptions[T any](r io.Reader, opts Options) ([]T, error) {
+	st := newReadState[T]()
+	if opts.TypeConsistencyCheck && !opts.CoerceQuotedNumbers {
+		st.quoted = map[int]int{}
+	}
+	records, err := readToArr(r, opts, st)
+	if err != nil {
+		return nil, fmt.Errorf("read file error %w", err)
+	}
+
+	return recordsToStruct[T](context.Background(), records, opts, st)
+}
+
+// Read every file matching the filepath.Glob pattern, in name order, and
+// concatenate the rows. Set opts.SourceColumn to record which file each row
+// came from.
+func ReadToStructGlob[T any](pattern string, opts Options) ([]T, error) {
+	filenames, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	str := []T{}
+	for _, f := range filenames {
+		rows, err := ReadToStructWithOptions[T](f, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		str = append(str, rows...)
+	}
+	return str, nil
+}
+
+// setSource sets the string field named field of every row to filename
+func setSource[T any](rows []T, field string, filename string) error {
+	for i := range rows {
+		v := reflect.ValueOf(&rows[i]).Elem().FieldByName(field)
+		if v.Kind() != reflect.String {
+			return fmt.Errorf("source field %s is not a string field", field)
+		}
+		v.SetString(filename)
+	}
+	return nil
+}
+
+// Same as ReadToStruct but each line of the file is split into fields by split
+// instead of being parsed as CSV, blank lines are skipped. Header matching and
+// field conversion are unchanged.
+//
+//	re := regexp.MustCompile(`\s*\|\s*`)
+//	rows, err := ReadToStructWithSplitter[Test]("data.txt", func(line string) []string {
+//	    return re.Split(line, -1)
+//	})
+func ReadToStructWithSplitter[T any](filename string, split func(line string) []string) ([]T, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read file error unable to read file %s", err)
+	}
+	defer f.Close()
+
+	// a bufio.Scanner would fail on lines over 64 KiB
+	records := [][]string{}
+	br := bufio.NewReader(&trailingBlankReader{r: decodeBOM(f)})
+	for {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"); line != "" {
+			records = append(records, split(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read file error %w", err)
+		}
+	}
+
+	return recordsToStruct[T](context.Background(), records, Options{}, readState{})
+}
+
+// Same as ReadToStruct but a row that fails to convert does not stop the read.
+// Returns the converted rows, the raw cells of each failed row and the error for
+// each of them in the same order. The last error is only set when the file
+// cannot be read or the header does not match T.
+func ReadToStructPartial[T any](filename string) ([]T, [][]string, []error, error) {
+	return ReadToStructPartialWithOptions[T](filename, Options{})
+}
+
+// Same as ReadToStructPartial but parsing is controlled by opts. Once
+// opts.MaxErrors rows have failed reading stops and the rows gathered so far
+// are returned with ErrTooManyErrors.
+func ReadToStructPartialWithOptions[T any](filename string, opts Options) ([]T, [][]string, []error, error) {
+	records, err := readFileToArr(filename, opts, newReadState[T]())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("read file error %w", err)
+	}
+	rc, records, err := newRowConverter[T](records, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	str := []T{}
+	failed := [][]string{}
+	errs := []error{}
+	for i, r := range records[1:] {
+		if opts.MaxRows > 0 && len(str)+len(failed) == opts.MaxRows {
+			break
+		}
+		if rc.wrongWidth(r) {
+			failed = append(failed, r)
+			errs = append(errs, fmt.Errorf("row %d has %d fields, header has %d", i+2, len(r), rc.width))
+		} else if elem, err := rc.convert(r); err != nil {
+			failed = append(failed, r)
+			errs = append(errs, fmt.Errorf("row %d: %w", i+2, err))
+		} else {
+			if rc.inTimeRange(elem) {
+				str = append(str, *elem)
+			}
+			continue
+		}
+		if opts.MaxErrors > 0 && len(errs) == opts.MaxErrors {
+			return str, failed, errs, ErrTooManyErrors
+		}
+	}
+
+	return str, failed, errs, nil
+}
+
+// Same as ReadToStruct but mapping, header to Go field name, decides which
+// column each listed field is read from in place of its col tag. The fields do
+// not need a col tag, see LoadHeaderMapping.
+func ReadToStructWithMapping[T any](filename string, mapping map[string]string) ([]T, error) {
+	return ReadToStructWithOptions[T](filename, Options{ColumnMap: mapping})
+}
+
+// headerMapping is one row of a mapping file read by LoadHeaderMapping
+type headerMapping struct {
+	Source string `col:"source_header"`
+	Field  string `col:"struct_field"`
+}
+
+// Load a mapping for ReadToStructWithMapping or Options.ColumnMap from a CSV
+// with the columns source_header and struct_field
+// eg.
+//
+//	source_header,struct_field
+//	Customer Name,Name
+//	Cust. No,ID
+func LoadHeaderMapping(filename string) (map[string]string, error) {
+	rows, err := ReadToStruct[headerMapping](filename)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := make(map[string]string, len(rows))
+	for i, r := range rows {
+		if r.Source == "" || r.Field == "" {
+			return nil, fmt.Errorf("mapping row %d needs both source_header and struct_field", i+2)
+		}
+		if _, ok := mapping[r.Source]; ok {
+			return nil, fmt.Errorf("mapping row %d repeats source_header %s", i+2, r.Source)
+		}
+		mapping[r.Source] = r.Field
+	}
+	return mapping, nil
+}
+
+// Same as ReadToStruct but a bad row does not stop the read, every row that
+// converts is returned along with a RowError for each one that does not
+func ReadToStructCollect[T any](filename string) ([]T, []RowError, error) {
+	return ReadToStructCollectWithOptions[T](filename, Options{})
+}
+
+// Same as ReadToStructCollect but parsing is controlled by opts. Once
+// opts.MaxErrors rows have failed reading stops and the rows gathered so far
+// are returned with ErrTooManyErrors.
+func ReadToStructCollectWithOptions[T any](filename string, opts Options) ([]T, []RowError, error) {
+	records, err := readFileToArr(filename, opts, newReadState[T]())
+	if err != nil {
+		return nil, nil, fmt.Errorf("read file error %w", err)
+	}
+	rc, records, err := newRowConverter[T](records, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	str := []T{}
+	rowErrs := []RowError{}
+	for i, r := range records[1:] {
+		if opts.MaxRows > 0 && len(str)+len(rowErrs) == opts.MaxRows {
+			break
+		}
+		if rc.wrongWidth(r) {
+			rowErrs = append(rowErrs, RowError{Row: i + 2, Err: fmt.Errorf("%d fields, header has %d", len(r), rc.width)})
+		} else if elem, err := rc.convert(r); err != nil {
+			rowErr := RowError{Row: i + 2, Err: err}
+			var colErr *columnError
+			if errors.As(err, &colErr) {
+				rowErr.Column, rowErr.Err = colErr.Column, colErr.Err
+			}
+			rowErrs = append(rowErrs, rowErr)
+		} else {
+			if rc.inTimeRange(elem) {
+				str = append(str, *elem)
+			}
+			continue
+		}
+		if opts.MaxErrors > 0 && len(rowErrs) == opts.MaxErrors {
+			return str, rowErrs, ErrTooManyErrors
+		}
+	}
+
+	return str, rowErrs, nil
+}
+
+// rowConverter converts the data rows of already parsed records into T, set up
+// the same way for recordsToStruct, ReadToStructPartialWithOptions and
+// ReadToStructCollectWithOptions
+type rowConverter[T any] struct {
+	conv      func(row []string) (*T, error)
+	width     int
+	opts      Options
+	timeIndex []int
+}
+
+// newRowConverter names the empty cells of the header, records[0], merges
+// continuation rows, maps the header onto T and finds the TimeRangeField. It
+// returns the records to convert, header first.
+func newRowConverter[T any](records [][]string, opts Options) (*rowConverter[T], [][]string, error) {
+	if len(records) == 0 {
+		return nil, nil, ErrNoHeader
+	}
+	if err := nameEmptyHeaders(records[0], opts.EmptyHeaders); err != nil {
+		return nil, nil, err
+	}
+	if opts.Continuation != nil {
+		records = append(records[:1], mergeContinuations(records[1:], opts.Continuation)...)
+	}
+
+	conv, err := readColumnDefCreateStruct[T](records[0], opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	timeIndex, err := timeRangeIndex[T](opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &rowConverter[T]{conv: conv, width: len(records[0]), opts: opts, timeIndex: timeIndex}, records, nil
+}
+
+// wrongWidth reports whether row fails Options.StrictRowWidth
+func (rc *rowConverter[T]) wrongWidth(row []string) bool {
+	return rc.opts.StrictRowWidth && len(row) != rc.width
+}
+
+// convert converts one data row into T
+func (rc *rowConverter[T]) convert(row []string) (*T, error) {
+	return convertRow(rc.conv, row, rc.opts.RecoverPanics)
+}
+
+// inTimeRange reports whether elem is kept by Options.TimeRangeField
+func (rc *rowConverter[T]) inTimeRange(elem *T) bool {
+	return rc.timeIndex == nil || inTimeRange(reflect.ValueOf(elem).Elem().FieldByIndex(rc.timeIndex).Interface().(time.Time), rc.opts)
+}
+
+// recordsToStruct converts already parsed records, header first, into T,
+// stopping early with ctx.Err() once ctx is done
+func recordsToStruct[T any](ctx context.Context, records [][]string, opts Options, st readState) ([]T, error) {
+	rc, records, err := newRowConverter[T](records, opts)
+	if err != nil {
+		return nil, err
+	}
+	str := []T{}
+	if opts.PreValidateTypes {
+		if err := preValidateTypes(reflect.TypeOf(new(T)).Elem(), records, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.TypeConsistencyCheck {
+		preserved, err := preservedColumns(reflect.TypeOf(new(T)).Elem(), records[0], opts)
+		if err != nil {
+			return nil, err
+		}
+		for j, q := range st.quoted {
+			if q == 1 {
+				preserved[j] = true
+			}
+		}
+		if err := checkTypeConsistency(records, preserved); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, r := range records {
+		if i == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if opts.MaxRows > 0 && len(str) == opts.MaxRows {
+			break
+		}
+		if rc.wrongWidth(r) {
+			err := fmt.Errorf("row %d has %d fields, header has %d", i+1, len(r), rc.width)
+			if opts.OnError != nil && opts.OnError(i+1, err) {
+				continue
+			}
+			return nil, err
+		}
+		if elem, err := rc.convert(r); err != nil {
+			if opts.OnError != nil && opts.OnError(i+1, err) {
+				continue
+			}
+			return nil, fmt.Errorf("row %d: %w", i+1, err)
+		} else if rc.inTimeRange(elem) {
+			str = append(str, *elem)
+		}
+	}
+
+	return str, nil
+}
+
+// timeRangeIndex is the index of the opts.TimeRangeField field of T, nil when
+// no time range is set
+func timeRangeIndex[T any](opts Options) ([]int, error) {
+	if opts.TimeRangeField == "" {
+		return nil, nil
+	}
+	fld, ok := reflect.TypeOf(new(T)).Elem().FieldByName(opts.TimeRangeField)
+	if !ok || fld.Type != timeType {
+		return nil, fmt.Errorf("time range field %s is not a time.Time field", opts.TimeRangeField)
+	}
+	return fld.Index, nil
+}
+
+// inTimeRange reports whether t is within opts.TimeFrom and opts.TimeTo, both
+// inclusive, a zero bound is open
+func inTimeRange(t time.Time, opts Options) bool {
+	if !opts.TimeFrom.IsZero() && t.Before(opts.TimeFrom) {
+		return false
+	}
+	return opts.TimeTo.IsZero() || !t.After(opts.TimeTo)
+}
+
+// Write to CSV using tag from stuct
+// eg.
+//
+//	type Test struct {
+//	   Field1 string `col:"column name"`
+//	}
+//
+// will become
+// | column name  |
+// | field1 value |
+func WriteFromStruct[T any](filename string, in []T) error {
+	return WriteFromStructWithOptions(filename, in, Options{})
+}
+
+// Same as WriteFromStruct but output is controlled by opts
+func WriteFromStructWithOptions[T any](filename string, in []T, opts Options) error {
+	out, err := encodeRecords(in, opts)
+	if err != nil {
+		return err
+	}
+
+	return writeRecords(filename, out, opts, opts.comma())
+}
+
+// Same as WriteFromStruct but the CSV is written to w, eg. a gzip.Writer
+func EncodeToWriter[T any](w io.Writer, in []T) error {
+	return EncodeToWriterWithOptions(w, in, Options{})
+}
+
+// Same as EncodeToWriter but output is controlled by opts. Nothing is written
+// to w when a field can not be formatted.
+func EncodeToWriterWithOptions[T any](w io.Writer, in []T, opts Options) error {
+	out, err := encodeRecords(in, opts)
+	if err != nil {
+		return err
+	}
+
+	return writeRecordsTo(w, out, opts, opts.comma())
+}
+
+// encodeRecords builds and checks the records of in for the *WithOptions
+// writers, nothing is written to the output when it fails
+func encodeRecords[T any](in []T, opts Options) ([][]string, error) {
+	if err := validateDelimiter(opts.comma()); err != nil {
+		return nil, fmt.Errorf("write error %w", err)
+	}
+	out, err := structToRecords(in, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ValidateUTF8 {
+		if err := validateUTF8(out, opts); err != nil {
+			return nil, fmt.Errorf("write error %w", err)
+		}
+	}
+	if opts.PreviewTo != nil {
+		if err := writePreview(opts.PreviewTo, out, opts.PreviewRows); err != nil {
+			return nil, fmt.Errorf("preview error %w", err)
+		}
+	}
+	return out, nil
+}
+
+// Same as WriteFromStruct but the rows are added to the end of filename. The
+// header is only written when the file is new or empty, an existing header is
+// assumed to match T.
+func AppendFromStruct[T any](filename string, in []T) error {
+	out, err := structToRecords(in, Options{})
+	if err != nil {
+		return err
+	}
+
+	wf, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write file %w", err)
+	}
+	info, err := wf.Stat()
+	if err != nil {
+		wf.Close()
+		return fmt.Errorf("unable to write file %w", err)
+	}
+	if info.Size() > 0 {
+		out = out[1:]
+	}
+
+	if err := writeRecordsTo(wf, out, Options{}, ','); err != nil {
+		wf.Close()
+		return err
+	}
+	return wf.Close()
+}
+
+// Write the same rows to several files, each key of targets is a filename and
+// its value is the delimiter used for that file
+// eg.
+//
+//	WriteFromStructMulti(in, map[string]rune{"out.csv": ',', "out.tsv": '\t'})
+func WriteFromStructMulti[T any](in []T, targets map[string]rune) error {
+	out, err := structToRecords(in, Options{})
+	if err != nil {
+		return err
+	}
+
+	filenames := make([]string, 0, len(targets))
+	for f, comma := range targets {
+		if err := validateDelimiter(comma); err != nil {
+			return fmt.Errorf("write %s error %w", f, err)
+		}
+		filenames = append(filenames, f)
+	}
+	sort.Strings(filenames)
+	for _, f := range filenames {
+		if err := writeRecords(f, out, Options{}, targets[f]); err != nil {
+			return fmt.Errorf("write %s error %w", f, err)
+		}
+	}
+
+	return nil
+}
+
+// Write in to one file per distinct keyFn value, each named <key>.csv inside dir
+// with its own header. Rows keep their relative order. Returns the filename
+// written for each key.
+func WriteFromStructPartitioned[T any](dir string, in []T, keyFn func(T) string) (map[string]string, error) {
+	parts := map[string][]T{}
+	for _, r := range in {
+		key := keyFn(r)
+		if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+			return nil, fmt.Errorf("partition key %q can not be used as a filename", key)
+		}
+		parts[key] = append(parts[key], r)
+	}
+
+	files := map[string]string{}
+	for key, rows := range parts {
+		filename := filepath.Join(dir, key+".csv")
+		if err := WriteFromStruct(filename, rows); err != nil {
+			return files, fmt.Errorf("write partition %s error %w", key, err)
+		}
+		files[key] = filename
+	}
+
+	return files, nil
+}
+
+// structToRecords builds the header and one row per element of in, which may
+// be structs or pointers to them
+func structToRecords[T any](in []T, opts Options) ([][]string, error) {
+	out := [][]string{}
+	elem := reflect.TypeOf(new(T)).Elem()
+	isPtr := elem.Kind() == reflect.Pointer
+	if isPtr {
+		elem = elem.Elem()
+	}
+	header, err := headerFields(elem)
+	if err != nil {
+		return nil, err
+	}
+	for k := range opts.ExpandFields {
+		if _, ok := elem.FieldByName(k); !ok {
+			return nil, fmt.Errorf("expanded field %s does not exist in %s", k, elem)
+		}
+	}
+
+	headRow := []string{}
+	// the rest field writes any number of cells, the columns from it on are
+	// not at the same index in every row
+	restAt := -1
+	// numeric fields by column, aggregated from their values rather than
+	// their cells
+	numericCols := map[int]reflect.StructField{}
+	for _, fld := range header {
+		if ex, ok := opts.ExpandFields[fld.Name]; ok {
+			headRow = append(headRow, ex.Headers...)
+		} else if name, ok := strings.CutPrefix(fld.Tag.Get("col"), restPrefix); ok {
+			restAt = len(headRow)
+			headRow = append(headRow, name)
+		} else {
+			if numericField(fld.Type) {
+				numericCols[len(headRow)] = fld
+			}
+			headRow = append(headRow, fld.Tag.Get("col"))
+		}
+	}
+	for _, c := range opts.ComputedColumns {
+		headRow = append(headRow, c.Header)
+	}
+	for _, c := range opts.TemplateColumns {
+		headRow = append(headRow, c.Header)
+	}
+
+	if opts.HeaderTransform != nil {
+		names := make([]string, len(headRow))
+		for j, h := range headRow {
+			names[j] = opts.HeaderTransform(h)
+		}
+		out = append(out, names)
+	} else {
+		out = append(out, headRow)
+	}
+	if opts.WriteTypeRow {
+		typeRow := []string{}
+		for _, fld := range header {
+			if ex, ok := opts.ExpandFields[fld.Name]; ok {
+				for range ex.Headers {
+					typeRow = append(typeRow, "string")
+				}
+			} else {
+				typeRow = append(typeRow, columnTypeName(fld.Type))
+			}
+		}
+		for range len(opts.ComputedColumns) + len(opts.TemplateColumns) {
+			typeRow = append(typeRow, "string")
+		}
+		out = append(out, typeRow)
+	}
+
+	// rows are numbered as in the output, counting the header as row 1
+	firstRow := len(out) + 1
+	buildRow := func(i int, r T) ([]string, error) {
+		row := make([]string, 0, len(headRow))
+		str := reflect.ValueOf(r)
+		if isPtr {
+			if str.IsNil() {
+				switch opts.NilElements {
+				case NilElementSkip:
+					return nil, nil
+				case NilElementEmpty:
+					return make([]string, len(headRow)), nil
+				}
+				return nil, fmt.Errorf("row %d: element %d is nil", firstRow+i, i)
+			}
+			str = str.Elem()
+		}
+
+		// the cells formatted from numbers, in order, which are never a
+		// formula whatever their tags made of them
+		var numeric []int
+		for _, fld := range header {
+			if ex, ok := opts.ExpandFields[fld.Name]; ok {
+				cells := ex.Split(str.FieldByIndex(fld.Index).Interface())
+				if len(cells) != len(ex.Headers) {
+					return nil, fmt.Errorf("expanded field %s gave %d columns, expected %d", fld.Name, len(cells), len(ex.Headers))
+				}
+				row = append(row, cells...)
+				continue
+			}
+			if strings.HasPrefix(fld.Tag.Get("col"), restPrefix) {
+				row = append(row, str.FieldByIndex(fld.Index).Interface().([]string)...)
+				continue
+			}
+			cell, err := formatField(str.FieldByIndex(fld.Index), fld, opts)
+			if err != nil {
+				return nil, err
+			}
+			if opts.SanitizeFormulas && numericField(fld.Type) {
+				numeric = append(numeric, len(row))
+			}
+			row = append(row, cell)
+		}
+		// the columns below get a T even from a []*T
+		rec := str.Interface()
+		for _, c := range opts.ComputedColumns {
+			row = append(row, c.Value(rec))
+		}
+		for _, c := range opts.TemplateColumns {
+			var b strings.Builder
+			if err := c.Template.Execute(&b, rec); err != nil {
+				return nil, fmt.Errorf("row %d column %s: %w", firstRow+i, c.Header, err)
+			}
+			row = append(row, b.String())
+		}
+		if opts.CellTransform != nil {
+			for j, cell := range row {
+				row[j] = opts.CellTransform(cellColumn(headRow, restAt, len(row), j), cell)
+			}
+		}
+		if opts.SanitizeFormulas {
+			for j, cell := range row {
+				if len(numeric) > 0 && numeric[0] == j {
+					numeric = numeric[1:]
+					continue
+				}
+				row[j] = sanitizeFormula(cell, opts.FormulaEscape)
+			}
+		}
+		return row, nil
+	}
+
+	if len(in) == 0 && opts.EmptySentinelRow {
+		return append(out, make([]string, len(headRow))), nil
+	}
+	if opts.WriteWorkers > 1 {
+		rows, err := buildRowsParallel(in, opts.WriteWorkers, buildRow)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if row != nil {
+				out = append(out, row)
+			}
+		}
+	} else {
+		for i, r := range in {
+			row, err := buildRow(i, r)
+			if err != nil {
+				return nil, err
+			}
+			if row != nil {
+				out = append(out, row)
+			}
+		}
+	}
+	if len(opts.Aggregates) > 0 {
+		elems := make([]reflect.Value, 0, len(in))
+		for _, r := range in {
+			str := reflect.ValueOf(r)
+			if isPtr {
+				if str.IsNil() {
+					continue
+				}
+				str = str.Elem()
+			}
+			elems = append(elems, str)
+		}
+		row, err := aggregateRow(headRow, restAt, numericCols, elems, out[firstRow-1:], opts)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, row)
+	}
+
+	return out, nil
+}
+
+// sanitizeFormula prefixes cell with escape, "'" when empty, if a spreadsheet
+// could run it as a formula. Numbers such as -5 are left alone.
+func sanitizeFormula(cell string, escape string) string {
+	if cell == "" || !strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return cell
+	}
+	if _, err := strconv.ParseFloat(cell, 64); err == nil {
+		return cell
+	}
+	if escape == "" {
+		escape = "'"
+	}
+	return escape + cell
+}
+
+// numericField reports whether a field of type t is formatted from a number,
+// eg. "-1,234" with a group tag or "-5ms" with a suffix tag
+func numericField(t reflect.Type) bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType) {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// cellColumn is the header name of cell j of a row width cells wide. Every
+// cell of the rest field at restAt, -1 when there is none, has its name.
+func cellColumn(headRow []string, restAt, width, j int) string {
+	if restAt < 0 || j < restAt {
+		return headRow[j]
+	}
+	restCells := width - len(headRow) + 1
+	if j < restAt+restCells {
+		return headRow[restAt]
+	}
+	return headRow[j-restCells+1]
+}
+
+// aggregateRow computes opts.Aggregates over the written rows. The columns of
+// numericCols are computed from those fields of elems and formatted like them,
+// any other column from its formatted cells in rows. Empty and NullString
+// cells are left out, AggregateLabel goes in the first column with no
+// aggregate. Columns from restAt on can not be aggregated, -1 when there is no
+// rest field.
+func aggregateRow(headRow []string, restAt int, numericCols map[int]reflect.StructField, elems []reflect.Value, rows [][]string, opts Options) ([]string, error) {
+	for h := range opts.Aggregates {
+		j := slices.Index(headRow, h)
+		if j < 0 {
+			return nil, fmt.Errorf("aggregate column %s does not exist", h)
+		}
+		if j == restAt {
+			return nil, fmt.Errorf("aggregate column %s is a rest field", h)
+		}
+		if restAt >= 0 && j > restAt {
+			return nil, fmt.Errorf("aggregate column %s follows the rest field %s", h, headRow[restAt])
+		}
+	}
+
+	out := make([]string, len(headRow))
+	label := opts.AggregateLabel
+	for j, h := range headRow {
+		agg, ok := opts.Aggregates[h]
+		if !ok {
+			if label != "" {
+				out[j], label = label, ""
+			}
+			continue
+		}
+		if agg < AggregateSum || agg > AggregateCount {
+			return nil, fmt.Errorf("aggregate column %s: unknown aggregate %d", h, agg)
+		}
+		if fld, ok := numericCols[j]; ok {
+			cell, err := aggregateField(fld, elems, agg, opts)
+			if err != nil {
+				return nil, fmt.Errorf("aggregate column %s: %w", h, err)
+			}
+			out[j] = cell
+			continue
+		}
+		sum, count := 0.0, 0
+		for _, row := range rows {
+			if j >= len(row) {
+				continue
+			}
+			cell := strings.TrimSpace(row[j])
+			if cell == "" || (opts.NullString != "" && cell == opts.NullString) {
+				continue
+			}
+			count++
+			if agg == AggregateCount {
+				continue
+			}
+			if opts.AccountingNegatives {
+				cell = accountingNegative(cell)
+			}
+			v, err := strconv.ParseFloat(cell, 64)
+			if err != nil {
+				return nil, fmt.Errorf("aggregate column %s: %q is not a number", h, row[j])
+			}
+			sum += v
+		}
+		switch agg {
+		case AggregateSum:
+			out[j] = strconv.FormatFloat(sum, 'f', -1, 64)
+		case AggregateAvg:
+			if count > 0 {
+				out[j] = strconv.FormatFloat(sum/float64(count), 'f', -1, 64)
+			}
+		case AggregateCount:
+			out[j] = strconv.Itoa(count)
+		}
+	}
+	return out, nil
+}
+
+// aggregateField computes agg over the numeric field fld of elems and formats
+// the result with the tags of fld, eg. a sum of "1,234" with a group tag. Nil
+// pointers and, with NaNAsNull, NaN are left out. An average is a float unless
+// fld is a time.Duration.
+func aggregateField(fld reflect.StructField, elems []reflect.Value, agg Aggregate, opts Options) (string, error) {
+	t := fld.Type
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var isum int64
+	var usum uint64
+	var fsum float64
+	count := 0
+	for _, str := range elems {
+		v := str.FieldByIndex(fld.Index)
+		if v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				continue
+			}
+			v = v.Elem()
+		}
+		switch {
+		case v.CanInt():
+			isum += v.Int()
+			fsum += float64(v.Int())
+		case v.CanUint():
+			usum += v.Uint()
+			fsum += float64(v.Uint())
+		default:
+			if opts.NaNAsNull && math.IsNaN(v.Float()) {
+				continue
+			}
+			fsum += v.Float()
+		}
+		count++
+	}
+
+	var total reflect.Value
+	switch agg {
+	case AggregateCount:
+		return strconv.Itoa(count), nil
+	case AggregateAvg:
+		if count == 0 {
+			return "", nil
+		}
+		avg := fsum / float64(count)
+		switch {
+		case t == durationType:
+			total = reflect.ValueOf(time.Duration(avg))
+		case t.Kind() == reflect.Float32:
+			total = reflect.ValueOf(float32(avg))
+		default:
+			total = reflect.ValueOf(avg)
+		}
+	default:
+		switch {
+		case t == durationType:
+			total = reflect.ValueOf(time.Duration(isum))
+		case t.Kind() == reflect.Float32:
+			total = reflect.ValueOf(float32(fsum))
+		case t.Kind() == reflect.Float64:
+			total = reflect.ValueOf(fsum)
+		case reflect.Zero(t).CanUint():
+			total = reflect.ValueOf(usum)
+		default:
+			total = reflect.ValueOf(isum)
+		}
+	}
+	fld.Type = total.Type()
+	return formatField(total, fld, opts)
+}
+
+// buildRowsParallel calls build for every element of in across workers
+// goroutines, each taking a contiguous chunk, and keeps the input order. The
+// error of the earliest failing element is returned.
+func buildRowsParallel[T any](in []T, workers int, build func(int, T) ([]string, error)) ([][]string, error) {
+	rows := make([][]string, len(in))
+	errs := make([]error, len(in))
+	chunk := (len(in) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for start := 0; start < len(in); start += chunk {
+		end := min(start+chunk, len(in))
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				rows[i], errs[i] = build(i, in[i])
+				if errs[i] != nil {
+					return
+				}
+			}
+		}(start, end)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// writeRecords creates filename and writes out to it separated by comma
+func writeRecords(filename string, out [][]string, opts Options, comma rune) error {
+	wf, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to write file %w", err)
+	}
+
+	if err := writeRecordsTo(wf, out, opts, comma); err != nil {
+		wf.Close()
+		return err
+	}
+	return wf.Close()
+}
+
+// writeRecordsTo writes out to wr separated by comma
+func writeRecordsTo(wr io.Writer, out [][]string, opts Options, comma rune) error {
+	var buf *bufio.Writer
+	if opts.BufferSize > 0 {
+		buf = bufio.NewWriterSize(wr, opts.BufferSize)
+		wr = buf
+	}
+	w := wr
+	var sum hash.Hash
+	if opts.WriteChecksum {
+		sum = sha256.New()
+		w = io.MultiWriter(wr, sum)
+	}
+	if opts.BOM {
+		if _, err := io.WriteString(w, utf8BOM); err != nil {
+			return fmt.Errorf("write error %w", err)
+		}
+	}
+
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Comma = comma
+	csvWriter.UseCRLF = opts.UseCRLF
+	lineEnd := "\n"
+	if opts.UseCRLF {
+		lineEnd = "\r\n"
+	}
+	for _, record := range out {
+		// csv writes a lone empty cell as a blank line, which readers skip,
+		// so a one column row such as the EmptySentinelRow would be lost
+		if len(record) == 1 && record[0] == "" {
+			csvWriter.Flush()
+			if _, err := io.WriteString(w, `""`+lineEnd); err != nil {
+				return fmt.Errorf("write error %w", err)
+			}
+			continue
+		}
+		if err := csvWriter.Write(record); err != nil {
+			return fmt.Errorf("write error %w", err)
+		}
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return fmt.Errorf("write error %w", err)
+	}
+
+	if opts.WriteChecksum {
+		trailer := checksumPrefix + hex.EncodeToString(sum.Sum(nil)) + "\n"
+		if opts.UseCRLF {
+			trailer = strings.TrimSuffix(trailer, "\n") + "\r\n"
+		}
+		if _, err := io.WriteString(wr, trailer); err != nil {
+			return fmt.Errorf("write error %w", err)
+		}
+	}
+
+	if buf != nil {
+		if err := buf.Flush(); err != nil {
+			return fmt.Errorf("write error %w", err)
+		}
+	}
+	return nil
+}
+
+// writePreview writes the header and up to rows rows of out to w as comment
+// lines with the columns aligned, 10 rows when rows is zero
+func writePreview(w io.Writer, out [][]string, rows int) error {
+	if rows <= 0 {
+		rows = 10
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, row := range out[:min(len(out), rows+1)] {
+		if _, err := fmt.Fprintln(tw, "# "+strings.Join(row, "\t")); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+// validateUTF8 checks every cell of out is valid UTF-8 and that nothing would
+// start the output with a BOM
+func validateUTF8(out [][]string, opts Options) error {
+	if opts.BOM {
+		return errors.New("BOM can not be written with ValidateUTF8")
+	}
+	if len(out) > 0 && len(out[0]) > 0 && strings.HasPrefix(out[0][0], utf8BOM) {
+		return errors.New("first header cell starts with a BOM")
+	}
+	for i, row := range out {
+		for j, cell := range row {
+			if utf8.ValidString(cell) {
+				continue
+			}
+			column := strconv.Itoa(j + 1)
+			if len(out[0]) > j {
+				column = out[0][j]
+			}
+			return fmt.Errorf("row %d column %s: invalid UTF-8 %q", i+1, column, cell)
+		}
+	}
+	return nil
+}
+
+// formatField renders field as a cell according to its kind and the tags on fld
+func formatField(field reflect.Value, fld reflect.StructField, opts Options) (string, error) {
+	cell := ""
+	if field.Kind() == reflect.Pointer {
+		if field.IsNil() {
+			return opts.NullString, nil
+		}
+		fld.Type = fld.Type.Elem()
+		return formatField(field.Elem(), fld, opts)
+	}
+	if cell, ok, err := marshalCSV(field, fld.Name); ok {
+		return cell, err
+	}
+	if field.CanFloat() && opts.NaNAsNull && math.IsNaN(field.Float()) {
+		return opts.NullString, nil
+	}
+	if field.Type() == timeType {
+		if opts.ZeroTimeAsNull && field.IsZero() {
+			return opts.NullString, nil
+		}
+		out, err := formatTime(field.Interface().(time.Time), fld.Tag)
+		if err != nil {
+			return "", fmt.Errorf("field time %s invalid: %s", fld.Name, err)
+		}
+		return out, nil
+	}
+	if field.Type() == durationType {
+		return formatDuration(time.Duration(field.Int()), opts.DurationUnit), nil
+	}
+	if fld.Tag.Get("nested") == "true" {
+		if field.Type() != nestedType {
+			return "", &UnsupportedTypeError{Field: fld.Name, Type: fld.Type}
+		}
+		out, err := formatNested(field.Interface().([][]string))
+		if err != nil {
+			return "", fmt.Errorf("field nested %s invalid: %s", fld.Name, err)
+		}
+		return out, nil
+	}
+	if fld.Tag.Get("json") == "true" {
+		if field.IsZero() {
+			return "", nil
+		}
+		b, err := json.Marshal(field.Interface())
+		if err != nil {
+			return "", fmt.Errorf("field json %s invalid: %s", fld.Name, err)
+		}
+		return string(b), nil
+	}
+	switch field.Kind() {
+	case reflect.Invalid:
+		return "", &UnsupportedTypeError{Field: fld.Name, Type: fld.Type}
+	case reflect.Bool:
+		cell = formatBool(field.Bool(), fld.Tag)
+	case reflect.Int32:
+		fallthrough
+	case reflect.Int8:
+		fallthrough
+	case reflect.Int16:
+		fallthrough
+	case reflect.Int64:
+		fallthrough
+	case reflect.Int:
+		cell = groupDigits(strconv.FormatInt(field.Int(), 10), fld.Tag.Get("group"))
+		if opts.AccountingNegatives && strings.HasPrefix(cell, "-") {
+			cell = "(" + cell[1:] + ")"
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		cell = groupDigits(strconv.FormatUint(field.Uint(), 10), fld.Tag.Get("group"))
+	case reflect.Float32:
+		out, err := formatFloat(field.Float(), fld.Tag, 32, opts)
+		if err != nil {
+			return "", fmt.Errorf("field float %s invalid: %s", fld.Name, err)
+		}
+		cell = out
+		if opts.AccountingNegatives && strings.HasPrefix(cell, "-") {
+			cell = "(" + cell[1:] + ")"
+		}
+	case reflect.Float64:
+		out, err := formatFloat(field.Float(), fld.Tag, 64, opts)
+		if err != nil {
+			return "", fmt.Errorf("field float %s invalid: %s", fld.Name, err)
+		}
+		cell = out
+		if opts.AccountingNegatives && strings.HasPrefix(cell, "-") {
+			cell = "(" + cell[1:] + ")"
+		}
+	case reflect.String:
+		cell = field.String()
+	case reflect.Slice:
+		sep := fld.Tag.Get("sep")
+		if sep == "" {
+			return "", &UnsupportedTypeError{Field: fld.Name, Type: fld.Type}
+		}
+		parts := make([]string, field.Len())
+		for i := range parts {
+			part, err := formatField(field.Index(i), reflect.StructField{Name: fld.Name, Type: fld.Type.Elem()}, opts)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = part
+		}
+		cell = strings.Join(parts, sep)
+	case reflect.Map:
+		sep := fld.Tag.Get("sep")
+		if sep == "" {
+			return "", &UnsupportedTypeError{Field: fld.Name, Type: fld.Type}
+		}
+		kv := fld.Tag.Get("kv")
+		if kv == "" {
+			kv = "="
+		}
+		pairs := []string{}
+		iter := field.MapRange()
+		for iter.Next() {
+			key, err := formatField(iter.Key(), reflect.StructField{Name: fld.Name, Type: iter.Key().Type()}, opts)
+			if err != nil {
+				return "", err
+			}
+			val, err := formatField(iter.Value(), reflect.StructField{Name: fld.Name, Type: iter.Value().Type()}, opts)
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, key+kv+val)
+		}
+		sort.Strings(pairs)
+		cell = strings.Join(pairs, sep)
+	default:
+		return "", &UnsupportedTypeError{Field: fld.Name, Type: fld.Type}
+	}
+	if sfx := fld.Tag.Get("suffix"); sfx != "" {
+		cell += strings.Split(sfx, ",")[0]
+	}
+	return cell, nil
+}
+
+// Write to CSV the way Excel expects it, a UTF-8 BOM so non ASCII text
+// is not garbled and CRLF line endings. Cells are only quoted when needed.
+func WriteForExcel[T any](filename string, in []T) error {
+	return WriteFromStructWithOptions(filename, in, Options{BOM: true, UseCRLF: true})
+}
+
+// Copy inFile to outFile with an extra last column named header, values holds
+// the cell for each data row in order so must have one entry per data row
+func AppendColumn(inFile, outFile, header string, values []string) error {
+	records, err := readFileToArr(inFile, Options{}, readState{})
+	if err != nil {
+		return fmt.Errorf("read file error %w", err)
+	}
+	if len(records) == 0 {
+		return ErrNoHeader
+	}
+	if len(values) != len(records)-1 {
+		return fmt.Errorf("got %d values for %d data rows", len(values), len(records)-1)
+	}
+
+	records[0] = append(records[0], header)
+	for i, v := range values {
+		records[i+1] = append(records[i+1], v)
+	}
+
+	return writeRecords(outFile, records, Options{}, ',')
+}
+
+// formatFloat writes f, a field with a scale tag is multiplied by the scale and
+// rounded to the integer it is stored as. Otherwise the fmt and prec tags pick
+// the strconv format and precision, falling back to opts.FloatFormat and
+// opts.FloatPrecision.
+func formatFloat(f float64, tag reflect.StructTag, bitSize int, opts Options) (string, error) {
+	if s := tag.Get("scale"); s != "" {
+		scale, err := parseScale(s)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(math.Round(f*scale), 'f', 0, 64), nil
+	}
+
+	format, prec := byte('f'), -1
+	if opts.FloatFormat != 0 {
+		format = opts.FloatFormat
+	}
+	if opts.FloatPrecision != nil {
+		prec = *opts.FloatPrecision
+	}
+	if s := tag.Get("fmt"); s != "" {
+		if len(s) != 1 {
+			return "", fmt.Errorf("fmt tag %s invalid", s)
+		}
+		format = s[0]
+	}
+	if s := tag.Get("prec"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return "", fmt.Errorf("prec tag %s invalid: %s", s, err)
+		}
+		prec = n
+	}
+	if !strings.ContainsRune("beEfgGxX", rune(format)) {
+		return "", fmt.Errorf("float format %q invalid", format)
+	}
+	return strconv.FormatFloat(f, format, prec, bitSize), nil
+}
+
+// groupDigits inserts sep between every three digits of the integer n
+func groupDigits(n string, sep string) string {
+	if sep == "" {
+		return n
+	}
+	sign := ""
+	if strings.HasPrefix(n, "-") {
+		sign, n = "-", n[1:]
+	}
+	parts := []string{}
+	for len(n) > 3 {
+		parts = append([]string{n[len(n)-3:]}, parts...)
+		n = n[:len(n)-3]
+	}
+	return sign + strings.Join(append([]string{n}, parts...), sep)
+}
+
+// columnTypeName is the name written in the type row for a field of type t
+func columnTypeName(t reflect.Type) string {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return "time"
+	}
+	if t == durationType {
+		return "duration"
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "uint"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	default:
+		return t.Kind().String()
+	}
+}
+
+// decodeBOM strips a leading UTF-8 BOM and decodes UTF-16 input marked by a
+// little or big endian BOM into UTF-8, input without a BOM is passed through
+func decodeBOM(r io.Reader) io.Reader {
+	return transform.NewReader(r, encunicode.BOMOverride(transform.Nop))
+}
+
+// trailingBlankReader drops whitespace after the last line break of the input,
+// eg. a file ending in "\n \n", which csv would otherwise read as one more
+// record holding " ". Whitespace followed by anything else is passed on.
+type trailingBlankReader struct {
+	r    io.Reader
+	buf  []byte
+	held []byte
+	out  []byte
+	err  error
+}
+
+func (t *trailingBlankReader) Read(p []byte) (int, error) {
+	for len(t.out) == 0 {
+		if t.err != nil {
+			return 0, t.err
+		}
+		if t.buf == nil {
+			t.buf = make([]byte, 4096)
+		}
+		n, err := t.r.Read(t.buf)
+		for _, c := range t.buf[:n] {
+			blank := c == ' ' || c == '\t' || c == '\r' || c == '\n'
+			if len(t.held) > 0 && blank {
+				t.held = append(t.held, c)
+				continue
+			}
+			t.out = append(t.out, t.held...)
+			t.held = t.held[:0]
+			if c == '\n' {
+				t.held = append(t.held, c)
+				continue
+			}
+			t.out = append(t.out, c)
+		}
+		if err != nil {
+			if len(t.held) > 0 {
+				t.out = append(t.out, '\n')
+				t.held = nil
+			}
+			t.err = err
+		}
+	}
+	n := copy(p, t.out)
+	t.out = t.out[n:]
+	return n, nil
+}
+
+// lineLimitReader fails with ErrLineTooLong once a line of r runs past max
+// bytes, before csv buffers it
+type lineLimitReader struct {
+	r    io.Reader
+	max  int
+	line int
+	n    int
+}
+
+func (l *lineLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	for i, b := range p[:n] {
+		if b == '\n' {
+			l.line++
+			l.n = 0
+			continue
+		}
+		l.n++
+		if l.n > l.max {
+			return i, fmt.Errorf("%w: line %d is over %d bytes", ErrLineTooLong, l.line+1, l.max)
+		}
+	}
+	return n, err
+}
+
+// openFile is os.Open, a variable so retries can be exercised
+var openFile = os.Open
+
+// openWithRetry opens filename, retrying up to opts.RetryOpen times with a
+// doubling delay. Missing files and permission errors are not retried.
+func openWithRetry(filename string, opts Options) (*os.File, error) {
+	delay := opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		f, err := openFile(filename)
+		if err == nil || attempt >= opts.RetryOpen || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+			return f, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func readFileToArr(filename string, opts Options, st readState) (rows [][]string, err error) {
+	f, err := openWithRetry(filename, opts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file %s", err)
+	}
+	defer f.Close()
+
+	return readToArr(f, opts, st)
+}
+
+// readToArr parses all the records of r
+func readToArr(r io.Reader, opts Options, st readState) ([][]string, error) {
+	if opts.VerifyChecksum {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read file %s", err)
+		}
+		body, err := verifyChecksum(data)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(body)
+	}
+
+	r, err := inputReader(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.RecordSeparator != 0 {
+		records, err := readSeparatedRecords(r, opts, st)
+		if opts.StripCellBOM {
+			for _, record := range records {
+				stripCellBOM(record)
+			}
+		}
+		return records, err
+	}
+	src := io.Reader(&trailingBlankReader{r: r})
+	var data []byte
+	var lineStarts []int
+	if st.quoted != nil {
+		// quoting is only visible in the raw input, kept to look it up by
+		// the position of each field
+		if data, err = io.ReadAll(src); err != nil {
+			return nil, fmt.Errorf("unable to read file %s", err)
+		}
+		src = bytes.NewReader(data)
+		lineStarts = lineOffsets(data)
+	}
+	rr, err := newRecordReader(src, opts, st)
+	if err != nil {
+		return nil, err
+	}
+	if rr.header == nil {
+		return [][]string{}, nil
+	}
+	records := [][]string{rr.header}
+	// the header and MaxRows data rows are all that will be converted, unless
+	// some rows read may not be returned
+	limit := opts.MaxRows > 0 && opts.Continuation == nil && opts.TimeRangeField == "" && opts.OnError == nil
+	for !limit || len(records) <= opts.MaxRows {
+		record, err := rr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse file as CSV %w", err)
+		}
+		if st.quoted != nil {
+			markQuoted(st.quoted, rr.Reader, record, data, lineStarts)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// inputReader checks the delimiters of opts and wraps r in the filters every
+// reader applies before parsing: SniffContent, MaxLineBytes and BOM decoding
+func inputReader(r io.Reader, opts Options) (io.Reader, error) {
+	if err := validateDelimiter(opts.comma()); err != nil {
+		return nil, fmt.Errorf("unable to parse file as CSV %w", err)
+	}
+	if opts.HeaderComma != 0 {
+		if err := validateDelimiter(opts.HeaderComma); err != nil {
+			return nil, fmt.Errorf("unable to parse file as CSV header %w", err)
+		}
+	}
+	if opts.SniffContent {
+		br := bufio.NewReader(decodeBOM(r))
+		if err := sniffContent(br); err != nil {
+			return nil, err
+		}
+		r = br
+	}
+	if opts.MaxLineBytes > 0 {
+		r = &lineLimitReader{r: r, max: opts.MaxLineBytes}
+	}
+	return decodeBOM(r), nil
+}
+
+// recordReader is a csv.Reader set up for opts that has read the header
+type recordReader struct {
+	*csv.Reader
+	// header is nil when the input ended before it
+	header []string
+	opts   Options
+	// wide is set when records may have more fields than the header
+	wide bool
+}
+
+// newRecordReader parses src, already passed through inputReader, and reads
+// its header, skipping the opts.HeaderRow records above it
+func newRecordReader(src io.Reader, opts Options, st readState) (*recordReader, error) {
+	rr := &recordReader{Reader: csv.NewReader(src), opts: opts, wide: st.ragged}
+	rr.Comma = opts.comma()
+	rr.Comment = opts.Comment
+	if opts.HeaderRow > 0 {
+		// junk above the header may have any width, once it is skipped the
+		// header sets the width again
+		rr.FieldsPerRecord = -1
+		for i := 0; i < opts.HeaderRow; i++ {
+			if _, err := rr.Read(); err == io.EOF {
+				return rr, nil
+			} else if err != nil {
+				return nil, fmt.Errorf("unable to parse file as CSV %s", err)
+			}
+		}
+		rr.FieldsPerRecord = 0
+	}
+	if opts.PadShortRows || st.ragged {
+		rr.FieldsPerRecord = -1
+	}
+	if opts.HeaderComma != 0 {
+		// the reader picks up Comma on every Read so only the header is
+		// split on HeaderComma
+		rr.Comma = opts.HeaderComma
+	}
+	header, err := rr.Read()
+	if err == io.EOF {
+		return rr, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to parse file as CSV %s", err)
+	}
+	rr.Comma = opts.comma()
+	if opts.StripCellBOM {
+		stripCellBOM(header)
+	}
+	rr.header = header
+	return rr, nil
+}
+
+// next reads the next data record, io.EOF at the end of the input
+func (rr *recordReader) next() ([]string, error) {
+	record, err := rr.Read()
+	if err != nil {
+		return nil, err
+	}
+	// PadShortRows turns off the parser's width check, only short records
+	// are let through
+	if rr.opts.PadShortRows && !rr.wide && len(record) > len(rr.header) {
+		line, _ := rr.FieldPos(0)
+		return nil, &csv.ParseError{StartLine: line, Line: line, Column: 1, Err: csv.ErrFieldCount}
+	}
+	if rr.opts.StripCellBOM {
+		stripCellBOM(record)
+	}
+	return record, nil
+}
+
+// stripCellBOM removes byte order marks from the start of each cell of record
+func stripCellBOM(record []string) {
+	for i, cell := range record {
+		record[i] = strings.TrimLeft(cell, utf8BOM)
+	}
+}
+
+// lineOffsets is the offset in data of the start of each line
+func lineOffsets(data []byte) []int {
+	starts := []int{0}
+	for i, b := range data {
+		if b == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+// markQuoted records in quoted whether each non empty cell of the record last
+// read by r was quoted in data, 1 while every cell of a column has been and
+// -1 once one was not
+func markQuoted(quoted map[int]int, r *csv.Reader, record []string, data []byte, lineStarts []int) {
+	for j, cell := range record {
+		if cell == "" || quoted[j] == -1 {
+			continue
+		}
+		line, col := r.FieldPos(j)
+		off := lineStarts[line-1] + col - 1
+		if off < len(data) && data[off] == '"' {
+			quoted[j] = 1
+		} else {
+			quoted[j] = -1
+		}
+	}
+}
+
+// sniffContent fails with ErrNotCSV when the first non blank byte of r shows
+// it is HTML or JSON, eg. an error page saved in place of a download
+func sniffContent(r *bufio.Reader) error {
+	head, _ := r.Peek(512)
+	trimmed := bytes.TrimLeft(head, " \t\r\n")
+	if len(trimmed) == 0 {
+		return nil
+	}
+	switch trimmed[0] {
+	case '<':
+		return fmt.Errorf("%w: content looks like HTML or XML", ErrNotCSV)
+	case '{':
+		return fmt.Errorf("%w: content looks like JSON", ErrNotCSV)
+	}
+	return nil
+}
+
+// readSeparatedRecords splits r on opts.RecordSeparator and parses each piece
+// as a single CSV record. Empty pieces and a line break ending a piece are
+// ignored.
+func readSeparatedRecords(r io.Reader, opts Options, st readState) ([][]string, error) {
+	sep := opts.RecordSeparator
+	if sep == opts.comma() || sep == '"' || sep == utf8.RuneError || !utf8.ValidRune(sep) {
+		return nil, fmt.Errorf("record separator %q invalid", sep)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file %s", err)
+	}
+
+	records := [][]string{}
+	skipped := 0
+	for i, piece := range strings.Split(string(data), string(sep)) {
+		piece = strings.TrimSuffix(strings.TrimSuffix(piece, "\n"), "\r")
+		if piece == "" {
+			continue
+		}
+		if skipped < opts.HeaderRow {
+			skipped++
+			continue
+		}
+		csvReader := csv.NewReader(strings.NewReader(piece))
+		csvReader.Comma = opts.comma()
+		csvReader.Comment = opts.Comment
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse file as CSV record %d %s", i+1, err)
+		}
+		if _, err := csvReader.Read(); err != io.EOF {
+			return nil, fmt.Errorf("unable to parse file as CSV record %d has an unquoted line break", i+1)
+		}
+		if len(records) > 0 && !st.ragged && (len(record) > len(records[0]) || !opts.PadShortRows && len(record) < len(records[0])) {
+			return nil, fmt.Errorf("unable to parse file as CSV record %d has %d fields, header has %d", i+1, len(record), len(records[0]))
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// verifyChecksum checks the trailer line written by WriteChecksum against the
+// content before it and returns that content without the trailer
+func verifyChecksum(data []byte) ([]byte, error) {
+	content := bytes.TrimRight(data, "\r\n")
+	idx := bytes.LastIndexByte(content, '\n')
+	last := content[idx+1:]
+	if !bytes.HasPrefix(last, []byte(checksumPrefix)) {
+		return nil, fmt.Errorf("checksum trailer missing")
+	}
+
+	body := content[:idx+1]
+	want := string(last[len(checksumPrefix):])
+	sum := sha256.Sum256(body)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return nil, fmt.Errorf("%w: trailer %s content %s", ErrChecksumMismatch, want, got)
+	}
+	return body, nil
+}
+
+// convertRow calls conv on row, if recoverPanics is set a panic inside conv,
+// eg. reflect refusing to set an unexported field, is returned as an error
+func convertRow[T any](conv func(row []string) (*T, error), row []string, recoverPanics bool) (elem *T, err error) {
+	if recoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				elem, err = nil, fmt.Errorf("panic during conversion: %v", r)
+			}
+		}()
+	}
+	return conv(row)
+}
+
+// nameEmptyHeaders applies mode to the empty names in header, renaming them in
+// place to column_<n> with n counted from 1
+func nameEmptyHeaders(header []string, mode EmptyHeaderMode) error {
+	for i, v := range header {
+		if strings.TrimSpace(v) != "" {
+			continue
+		}
+		switch mode {
+		case EmptyHeaderError:
+			return fmt.Errorf("header column %d has no name", i+1)
+		case EmptyHeaderName:
+			header[i] = "column_" + strconv.Itoa(i+1)
+		}
+	}
+	return nil
+}
+
+// mergeContinuations folds every row that cont reports as continuing the
+// previous one into it. Non empty cells are appended to the cell at the same
+// position separated by a newline, cells past the end of the previous row are added.
+func mergeContinuations(rows [][]string, cont func(prev, row []string) bool) [][]string {
+	out := [][]string{}
+	for _, r := range rows {
+		if len(out) == 0 || !cont(out[len(out)-1], r) {
+			out = append(out, append([]string{}, r...))
+			continue
+		}
+		prev := out[len(out)-1]
+		for i, c := range r {
+			if i >= len(prev) {
+				prev = append(prev, c)
+			} else if c != "" {
+				if prev[i] == "" {
+					prev[i] = c
+				} else {
+					prev[i] += "\n" + c
+				}
+			}
+		}
+		out[len(out)-1] = prev
+	}
+	return out
+}
+
+func readColumnDefCreateStruct[T any](colHeader []string, opts Options) (func(row []string) (*T, error), error) {
+	conv, err := readColumnDef(reflect.TypeOf(new(T)).Elem(), colHeader, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(row []string) (*T, error) {
+		t, err := conv(row)
+		if err != nil {
+			return nil, err
+		}
+		return t.Interface().(*T), nil
+	}, nil
+}
+
+// readColumnDef is readColumnDefCreateStruct for a struct type only known at
+// run time, the returned function gives a pointer to a new elem
+func readColumnDef(elem reflect.Type, colHeader []string, opts Options) (func(row []string) (reflect.Value, error), error) {
+	if elem.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%s is not struct", elem)
+	}
+	st := readState{}
+	if opts.InternStrings || len(taggedFields(elem, "intern")) > 0 {
+		// shared by every row converted by the returned function
+		st.interned = map[string]string{}
+	}
+	if opts.Strict {
+		if err := checkStrictHeader(elem, colHeader, opts); err != nil {
+			return nil, err
+		}
+	}
+	colDef, outErr := getStructTags(elem, colHeader, opts)
+	if outErr != nil {
+		return nil, fmt.Errorf("error during reading column tag %s", outErr)
+	}
+	for k := range opts.Derived {
+		if _, ok := elem.FieldByName(k); !ok {
+			return nil, fmt.Errorf("derived field %s does not exist in %s", k, elem)
+		}
+	}
+	joinDef, outErr := getJoinTags(elem, colHeader, opts.HeaderMatch)
+	if outErr != nil {
+		return nil, fmt.Errorf("error during reading column tag %s", outErr)
+	}
+	restDef, outErr := getRestTags(elem, colHeader, opts)
+	if outErr != nil {
+		return nil, fmt.Errorf("error during reading column tag %s", outErr)
+	}
+	rawDef, outErr := getRawTags(elem)
+	if outErr != nil {
+		return nil, fmt.Errorf("error during reading column tag %s", outErr)
+	}
+	hashDef, outErr := getHashTags(elem, colHeader, opts.HeaderMatch)
+	if outErr != nil {
+		return nil, fmt.Errorf("error during reading column tag %s", outErr)
+	}
+
+	return func(row []string) (reflect.Value, error) {
+		t := reflect.New(elem)
+		str := t.Elem()
+		if len(rawDef) > 0 {
+			raw := joinRow(row, opts.comma())
+			for _, k := range rawDef {
+				str.FieldByName(k).SetString(raw)
+			}
+		}
+		for k, cols := range hashDef {
+			str.FieldByName(k).SetString(hashCells(row, cols))
+		}
+		for k, cols := range joinDef {
+			fld, _ := elem.FieldByName(k)
+			parts := make([]string, 0, len(cols))
+			for _, v := range cols {
+				if v >= len(row) {
+					if opts.PadShortRows && fld.Tag.Get("required") != "true" {
+						continue
+					}
+					return reflect.Value{}, &columnError{Column: colHeader[v], Err: fmt.Errorf("field %s column %d missing, row has %d fields", k, v, len(row))}
+				}
+				parts = append(parts, columnCell(colHeader[v], row[v], opts))
+			}
+			cell := strings.Join(parts, fld.Tag.Get("join"))
+			if err := setField(str.FieldByName(k), fld, cell, opts, st); err != nil {
+				return reflect.Value{}, &columnError{Column: fld.Tag.Get("cols"), Err: withCell(err, cell)}
+			}
+		}
+		for k, v := range restDef {
+			if v < len(row) {
+				str.FieldByName(k).Set(reflect.ValueOf(slices.Clone(row[v:])))
+			}
+		}
+		for k, v := range colDef {
+			fld, _ := elem.FieldByName(k)
+			if v >= len(row) {
+				if opts.PadShortRows && fld.Tag.Get("required") != "true" {
+					continue
+				}
+				return reflect.Value{}, &columnError{Column: colHeader[v], Err: fmt.Errorf("field %s column %d missing, row has %d fields", k, v, len(row))}
+			}
+			cell := columnCell(colHeader[v], row[v], opts)
+			if err := setField(str.FieldByName(k), fld, cell, opts, st); err != nil {
+				return reflect.Value{}, &columnError{Column: colHeader[v], Err: withCell(err, cell)}
+			}
+		}
+
+		for k, fn := range opts.Derived {
+			out, err := fn(t.Interface())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("derived field %s invalid: %s", k, err)
+			}
+			field := str.FieldByName(k)
+			val := reflect.ValueOf(out)
+			if !val.IsValid() || !val.Type().AssignableTo(field.Type()) {
+				return reflect.Value{}, fmt.Errorf("derived field %s expects %s got %T", k, field.Type(), out)
+			}
+			field.Set(val)
+		}
+
+		return t, nil
+	}, nil
+}
+
+// preValidateTypes parses every mapped cell of records into a throw away value
+// of the field type and returns all the failures joined together
+func preValidateTypes(elem reflect.Type, records [][]string, opts Options) error {
+	colDef, err := getStructTags(elem, records[0], opts)
+	if err != nil {
+		return fmt.Errorf("error during reading column tag %s", err)
+	}
+
+	names := make([]string, 0, len(colDef))
+	for k := range colDef {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	errs := []error{}
+	for i, r := range records[1:] {
+		for _, k := range names {
+			v := colDef[k]
+			fld, _ := elem.FieldByName(k)
+			if v >= len(r) {
+				if !opts.PadShortRows || fld.Tag.Get("required") == "true" {
+					errs = append(errs, fmt.Errorf("row %d column %s: missing", i+2, records[0][v]))
+				}
+			} else {
+				cell := columnCell(records[0][v], r[v], opts)
+				if err := setField(reflect.New(fld.Type).Elem(), fld, cell, opts, readState{}); err != nil {
+					errs = append(errs, fmt.Errorf("row %d column %s: %w", i+2, records[0][v], withCell(err, cell)))
+				}
+			}
+			if opts.MaxErrors > 0 && len(errs) == opts.MaxErrors {
+				return errors.Join(append(errs, ErrTooManyErrors)...)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// maxCellInError is how much of a bad cell withCell quotes
+const maxCellInError = 64
+
+// withCell adds the cell that failed to parse to err, cut to maxCellInError
+// bytes so a huge cell does not swamp the message
+func withCell(err error, cell string) error {
+	if len(cell) > maxCellInError {
+		cut := maxCellInError
+		for cut > 0 && !utf8.RuneStart(cell[cut]) {
+			cut--
+		}
+		return fmt.Errorf("%w, cell %q...", err, cell[:cut])
+	}
+	return fmt.Errorf("%w, cell %q", err, cell)
+}
+
+// parseError drops the input strconv repeats in its errors, withCell adds
+// the cell instead
+func parseError(err error) error {
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		return numErr.Err
+	}
+	return err
+}
+
+// checkTypeConsistency infers the type of each column from the first data row
+// and returns an error for the first later cell of a different type. Empty
+// cells are not checked and a column empty in the first row is not checked.
+// Preserved columns are always strings.
+func checkTypeConsistency(records [][]string, preserved map[int]bool) error {
+	if len(records) < 2 {
+		return nil
+	}
+	types := make([]string, len(records[1]))
+	for j, cell := range records[1] {
+		types[j] = cellType(cell)
+		if preserved[j] {
+			types[j] = "string"
+		}
+	}
+
+	for i, r := range records[2:] {
+		for j, cell := range r {
+			if j >= len(types) || cell == "" || types[j] == "" || types[j] == "string" {
+				continue
+			}
+			if t := cellType(cell); t != types[j] && !(types[j] == "float" && t == "int") {
+				column := strconv.Itoa(j + 1)
+				if j < len(records[0]) {
+					column = records[0][j]
+				}
+				return fmt.Errorf("row %d column %s: %q is %s, first row is %s", i+3, column, cell, t, types[j])
+			}
+		}
+	}
+	return nil
+}
+
+// preservedColumns lists the columns read by fields tagged `preserve:"true"`,
+// which type inference must leave as strings
+func preservedColumns(elem reflect.Type, colHeader []string, opts Options) (map[int]bool, error) {
+	colDef, err := getStructTags(elem, colHeader, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error during reading column tag %s", err)
+	}
+	preserved := map[int]bool{}
+	for _, fld := range taggedFields(elem, "preserve") {
+		if n, ok := colDef[fld.Name]; ok && fld.Tag.Get("preserve") == "true" {
+			preserved[n] = true
+		}
+	}
+	return preserved, nil
+}
+
+// cellType names the narrowest type cell parses as, "" for an empty cell
+func cellType(cell string) string {
+	cell = strings.TrimSpace(cell)
+	if cell == "" {
+		return ""
+	}
+	if _, err := strconv.ParseInt(cell, 10, 64); err == nil {
+		return "int"
+	}
+	if _, err := strconv.ParseFloat(cell, 64); err == nil {
+		return "float"
+	}
+	if _, err := strconv.ParseBool(cell); err == nil {
+		return "bool"
+	}
+	return "string"
+}
+
+// columnCell applies the options keyed by column name to cell. A remapped value
+// is replaced first, then a column with a number format is rewritten with no
+// grouping and a "." decimal point, a currency column loses its symbol and ","
+// grouping, a percent column its "%" sign.
+func columnCell(column string, cell string, opts Options) string {
+	if v, ok := opts.ValueRemap[column][cell]; ok {
+		cell = v
+	}
+	if f, ok := opts.NumberFormats[column]; ok {
+		cell = f.normalize(cell)
+	}
+	if sym, ok := opts.CurrencyColumns[column]; ok {
+		cell = strings.TrimSpace(cell)
+		neg := opts.AccountingNegatives && isParenthesized(cell)
+		if neg {
+			cell = strings.TrimSpace(cell[1 : len(cell)-1])
+		}
+		if sym != "" {
+			cell = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(cell, sym), sym))
+		}
+		cell = strings.ReplaceAll(cell, ",", "")
+		if neg {
+			cell = "(" + cell + ")"
+		}
+	}
+	if opts.PercentColumns[column] {
+		cell = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(cell), "%"))
+	}
+	return cell
+}
+
+// setField parses cell into field according to its kind and the tags on fld
+func setField(field reflect.Value, fld reflect.StructField, cell string, opts Options, st readState) error {
+	k := fld.Name
+	if opts.NormalizeUnicodeSpace {
+		cell = normalizeSpace(cell)
+	}
+	if opts.TrimQuotes != "" {
+		cell = strings.Trim(cell, opts.TrimQuotes)
+	}
+	if field.Kind() == reflect.Pointer {
+		if cell == "" || (opts.NullString != "" && cell == opts.NullString) {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		elem := reflect.New(field.Type().Elem())
+		fld.Type = fld.Type.Elem()
+		if err := setField(elem.Elem(), fld, cell, opts, st); err != nil {
+			return err
+		}
+		field.Set(elem)
+		return nil
+	}
+	if ok, err := unmarshalCSV(field, k, cell); ok {
+		return err
+	}
+	if sfx := fld.Tag.Get("suffix"); sfx != "" {
+		cell = trimUnitSuffix(cell, sfx)
+	}
+	if fld.Tag.Get("nested") == "true" {
+		if field.Type() != nestedType {
+			return &UnsupportedTypeError{Field: k, Type: fld.Type}
+		}
+		out, err := parseNested(cell)
+		if err != nil {
+			return fmt.Errorf("field nested %s invalid: %s", k, err)
+		}
+		field.Set(reflect.ValueOf(out))
+		return nil
+	}
+	if fld.Tag.Get("json") == "true" {
+		if cell == "" {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		if err := json.Unmarshal([]byte(cell), field.Addr().Interface()); err != nil {
+			return fmt.Errorf("field json %s invalid: %s", k, err)
+		}
+		return nil
+	}
+	if field.Type() == timeType {
+		out, err := parseTime(cell, fld.Tag)
+		if err != nil {
+			return fmt.Errorf("field time %s invalid: %s", k, err)
+		}
+		field.Set(reflect.ValueOf(out))
+		return nil
+	}
+	if field.Type() == durationType {
+		out, err := parseDuration(cell, opts.DurationUnit)
+		if err != nil {
+			return fmt.Errorf("field duration %s invalid: %s", k, err)
+		}
+		field.SetInt(int64(out))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.Invalid:
+		return &UnsupportedTypeError{Field: k, Type: fld.Type}
+	case reflect.Bool:
+		out, err := parseBool(cell, fld.Tag)
+		if def, ok := fld.Tag.Lookup("unknown"); ok && err != nil {
+			out, err = parseBool(def, fld.Tag)
+		}
+		if err != nil {
+			err = fmt.Errorf("field bool %s invalid: %s", k, parseError(err))
+			return err
+		}
+		field.SetBool(out)
+		break
+	case reflect.Int32:
+		fallthrough
+	case reflect.Int8:
+		fallthrough
+	case reflect.Int16:
+		fallthrough
+	case reflect.Int64:
+		fallthrough
+	case reflect.Int:
+		if opts.AccountingNegatives {
+			cell = accountingNegative(cell)
+		}
+		if sep := fld.Tag.Get("group"); sep != "" {
+			cell = strings.ReplaceAll(cell, sep, "")
+		}
+		if opts.StripLeadingZeros {
+			cell = stripLeadingZeros(cell)
+		}
+		if opts.StrictNumbers {
+			if err := plainNumber(cell, false); err != nil {
+				return fmt.Errorf("field int %s invalid: %s", k, err)
+			}
+		}
+		out, err := strconv.ParseInt(cell, 10, field.Type().Bits())
+		if err == nil {
+			out, err = boundInt(fld.Tag, out)
+		}
+		if err != nil {
+			err = fmt.Errorf("field int %s invalid: %s", k, parseError(err))
+			return err
+		}
+		field.SetInt(out)
+		break
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if sep := fld.Tag.Get("group"); sep != "" {
+			cell = strings.ReplaceAll(cell, sep, "")
+		}
+		if opts.StripLeadingZeros {
+			cell = stripLeadingZeros(cell)
+		}
+		if opts.StrictNumbers {
+			if err := plainNumber(cell, false); err != nil {
+				return fmt.Errorf("field uint %s invalid: %s", k, err)
+			}
+		}
+		out, err := strconv.ParseUint(cell, 10, field.Type().Bits())
+		if err != nil {
+			err = fmt.Errorf("field uint %s invalid: %s", k, parseError(err))
+			return err
+		}
+		field.SetUint(out)
+		break
+	case reflect.Float32:
+		if opts.AccountingNegatives {
+			cell = accountingNegative(cell)
+		}
+		if opts.StripLeadingZeros {
+			cell = stripLeadingZeros(cell)
+		}
+		if opts.StrictNumbers {
+			if err := plainNumber(cell, true); err != nil {
+				return fmt.Errorf("field float %s invalid: %s", k, err)
+			}
+		}
+		out, err := parseFloat(cell, fld.Tag, 32)
+		if err != nil {
+			err = fmt.Errorf("field float %s invalid: %s", k, parseError(err))
+			return err
+		}
+		field.SetFloat(out)
+		break
+	case reflect.Float64:
+		if opts.AccountingNegatives {
+			cell = accountingNegative(cell)
+		}
+		if opts.StripLeadingZeros {
+			cell = stripLeadingZeros(cell)
+		}
+		if opts.StrictNumbers {
+			if err := plainNumber(cell, true); err != nil {
+				return fmt.Errorf("field float %s invalid: %s", k, err)
+			}
+		}
+		out, err := parseFloat(cell, fld.Tag, 64)
+		if err != nil {
+			err = fmt.Errorf("field float %s invalid: %s", k, parseError(err))
+			return err
+		}
+		field.SetFloat(out)
+		break
+	case reflect.String:
+		if enum := fld.Tag.Get("enum"); enum != "" {
+			out, err := matchEnum(cell, enum, opts.EnumFold)
+			if def, ok := fld.Tag.Lookup("unknown"); ok && err != nil {
+				out, err = matchEnum(def, enum, opts.EnumFold)
+			}
+			if err != nil {
+				err = fmt.Errorf("field enum %s invalid: %s", k, err)
+				return err
+			}
+			field.SetString(out)
+			break
+		}
+		if opts.LowercaseStrings {
+			cell = strings.ToLower(cell)
+		}
+		if st.interned != nil && (opts.InternStrings || fld.Tag.Get("intern") == "true") {
+			if v, ok := st.interned[cell]; ok {
+				cell = v
+			} else {
+				cell = strings.Clone(cell)
+				st.interned[cell] = cell
+			}
+		}
+		field.SetString(cell)
+		break
+	case reflect.Slice:
+		sep := fld.Tag.Get("sep")
+		if sep == "" {
+			return &UnsupportedTypeError{Field: k, Type: fld.Type}
+		}
+		if cell == "" {
+			field.Set(reflect.Zero(field.Type()))
+			break
+		}
+		parts := strings.Split(cell, sep)
+		sl := reflect.MakeSlice(field.Type(), len(parts), len(parts))
+		for i, part := range parts {
+			if err := setField(sl.Index(i), reflect.StructField{Name: k, Type: sl.Type().Elem()}, part, opts, st); err != nil {
+				return fmt.Errorf("field slice %s element %d invalid: %w", k, i, err)
+			}
+		}
+		field.Set(sl)
+		break
+	case reflect.Map:
+		sep := fld.Tag.Get("sep")
+		if sep == "" {
+			return &UnsupportedTypeError{Field: k, Type: fld.Type}
+		}
+		if cell == "" {
+			field.Set(reflect.Zero(field.Type()))
+			break
+		}
+		kv := fld.Tag.Get("kv")
+		if kv == "" {
+			kv = "="
+		}
+		m := reflect.MakeMap(field.Type())
+		for _, pair := range strings.Split(cell, sep) {
+			key, val, ok := strings.Cut(pair, kv)
+			if !ok {
+				return fmt.Errorf("field map %s invalid: %q has no %q", k, pair, kv)
+			}
+			mk := reflect.New(field.Type().Key()).Elem()
+			if err := setField(mk, reflect.StructField{Name: k, Type: mk.Type()}, key, opts, st); err != nil {
+				return err
+			}
+			mv := reflect.New(field.Type().Elem()).Elem()
+			if err := setField(mv, reflect.StructField{Name: k, Type: mv.Type()}, val, opts, st); err != nil {
+				return err
+			}
+			m.SetMapIndex(mk, mv)
+		}
+		field.Set(m)
+		break
+	default:
+		return &UnsupportedTypeError{Field: k, Type: fld.Type}
+	}
+	return nil
+}
+
+// checkMarks are the cells read as true by `boolmode:"mark"`
+var checkMarks = []string{"✓", "✔", "☑", "✅", "x", "X"}
+
+// parseBool maps cell to a bool using the comma separated literals of the true
+// and false tags, any other value is an error. Without them strconv.ParseBool is
+// used. With `boolmode:"presence"` any non empty cell is true, with
+// `boolmode:"mark"` a check mark, or a true tag literal, is true and blank is false.
+func parseBool(cell string, tag reflect.StructTag) (bool, error) {
+	switch tag.Get("boolmode") {
+	case "presence":
+		return cell != "", nil
+	case "mark":
+		if cell == "" {
+			return false, nil
+		}
+		marks := checkMarks
+		if v, ok := tag.Lookup("true"); ok {
+			marks = strings.Split(v, ",")
+		}
+		if slices.Contains(marks, cell) {
+			return true, nil
+		}
+		return false, fmt.Errorf("%q is not a check mark or blank", cell)
+	}
+	trueTag, hasTrue := tag.Lookup("true")
+	falseTag, hasFalse := tag.Lookup("false")
+	if !hasTrue && !hasFalse {
+		return strconv.ParseBool(cell)
+	}
+	if hasTrue && slices.Contains(strings.Split(trueTag, ","), cell) {
+		return true, nil
+	}
+	if hasFalse && slices.Contains(strings.Split(falseTag, ","), cell) {
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not one of true %q or false %q", cell, trueTag, falseTag)
+}
+
+// formatBool writes b as the first literal of the true or false tag, or as
+// strconv.FormatBool. In presence and mark mode false is empty and true is the
+// true tag, or "1" and "✓" respectively.
+func formatBool(b bool, tag reflect.StructTag) string {
+	if mode := tag.Get("boolmode"); mode == "presence" || mode == "mark" {
+		if !b {
+			return ""
+		}
+		if v, ok := tag.Lookup("true"); ok {
+			return strings.Split(v, ",")[0]
+		}
+		if mode == "mark" {
+			return checkMarks[0]
+		}
+		return "1"
+	}
+	name := "false"
+	if b {
+		name = "true"
+	}
+	if v, ok := tag.Lookup(name); ok {
+		return strings.Split(v, ",")[0]
+	}
+	return strconv.FormatBool(b)
+}
+
+// isParenthesized reports whether cell is wrapped in "(" and ")"
+func isParenthesized(cell string) bool {
+	return len(cell) >= 2 && cell[0] == '(' && cell[len(cell)-1] == ')'
+}
+
+// accountingNegative turns "(1,234.50)" into "-1234.50", dropping the ","
+// grouping accounting exports put inside the parentheses. Other cells are
+// unchanged.
+func accountingNegative(cell string) string {
+	cell = strings.TrimSpace(cell)
+	if !isParenthesized(cell) {
+		return cell
+	}
+	return "-" + strings.ReplaceAll(strings.TrimSpace(cell[1:len(cell)-1]), ",", "")
+}
+
+// stripLeadingZeros trims the padding of a fixed width number, surrounding
+// spaces and zeros before the first significant digit, so " 00042" is "42".
+// A sign is kept and a lone zero stays "0".
+func stripLeadingZeros(cell string) string {
+	cell = strings.TrimSpace(cell)
+	sign := ""
+	if strings.HasPrefix(cell, "-") || strings.HasPrefix(cell, "+") {
+		sign, cell = cell[:1], cell[1:]
+	}
+	for len(cell) > 1 && cell[0] == '0' && cell[1] >= '0' && cell[1] <= '9' {
+		cell = cell[1:]
+	}
+	return sign + cell
+}
+
+// normalizeSpace replaces every Unicode space, eg. U+00A0, with an ASCII space and trims the result
+func normalizeSpace(cell string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		return r
+	}, cell))
+}
+
+// trimUnitSuffix removes the longest of the comma separated suffixes that cell ends with
+func trimUnitSuffix(cell string, suffixes string) string {
+	best := ""
+	for _, sfx := range strings.Split(suffixes, ",") {
+		if strings.HasSuffix(cell, sfx) && len(sfx) > len(best) {
+			best = sfx
+		}
+	}
+	return strings.TrimSuffix(cell, best)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+var nestedType = reflect.TypeOf([][]string(nil))
+
+// parseNested reads cell as a CSV of its own, rows may differ in width. An
+// empty cell is nil.
+func parseNested(cell string) ([][]string, error) {
+	if cell == "" {
+		return nil, nil
+	}
+	r := csv.NewReader(strings.NewReader(cell))
+	r.FieldsPerRecord = -1
+	return r.ReadAll()
+}
+
+// formatNested writes rows as a CSV without the final line break
+func formatNested(rows [][]string) (string, error) {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	if err := w.WriteAll(rows); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// formatDuration writes d as Duration.String, eg. "1h30m0s", or as a count of
+// unit when unit is set
+func formatDuration(d time.Duration, unit time.Duration) string {
+	if unit == 0 {
+		return d.String()
+	}
+	return strconv.FormatFloat(float64(d)/float64(unit), 'f', -1, 64)
+}
+
+// parseDuration reads a count of unit when unit is set, otherwise a Go duration
+// such as "1h30m" or a plain integer of nanoseconds. An empty cell is zero.
+func parseDuration(cell string, unit time.Duration) (time.Duration, error) {
+	if cell == "" {
+		return 0, nil
+	}
+	if unit != 0 {
+		n, err := strconv.ParseFloat(cell, 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(math.Round(n * float64(unit))), nil
+	}
+	if n, err := strconv.ParseInt(cell, 10, 64); err == nil {
+		return time.Duration(n), nil
+	}
+	return time.ParseDuration(cell)
+}
+
+// timeLayouts are the "|" separated layouts of the time tag of a field, or
+// RFC3339 when there is none
+func timeLayouts(tag reflect.StructTag) []string {
+	if layout := tag.Get("time"); layout != "" {
+		return strings.Split(layout, "|")
+	}
+	return []string{time.RFC3339}
+}
+
+// timeLocation loads the location named by the tz tag, nil when there is none
+func timeLocation(tag reflect.StructTag) (*time.Location, error) {
+	tz := tag.Get("tz")
+	if tz == "" {
+		return nil, nil
+	}
+	if loc, ok := locations.Load(tz); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("tz tag %s invalid: %s", tz, err)
+	}
+	locations.Store(tz, loc)
+	return loc, nil
+}
+
+// locations caches time.LoadLocation by tz tag
+var locations sync.Map
+
+// parseTime parses cell with the time tag layouts, longest layout first so a
+// full timestamp is preferred over a date, which parses to midnight. An empty
+// cell is the zero time. A cell without a zone is taken to be in the tz tag
+// location, or UTC.
+func parseTime(cell string, tag reflect.StructTag) (time.Time, error) {
+	if cell == "" {
+		return time.Time{}, nil
+	}
+	loc, err := timeLocation(tag)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	layouts := timeLayouts(tag)
+	sort.SliceStable(layouts, func(i, j int) bool { return len(layouts[i]) > len(layouts[j]) })
+	var firstErr error
+	for _, layout := range layouts {
+		t, err := time.ParseInLocation(layout, cell, loc)
+		if err == nil {
+			return t, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return time.Time{}, firstErr
+}
+
+// formatTime formats t with the first time tag layout in the tz tag location if any
+func formatTime(t time.Time, tag reflect.StructTag) (string, error) {
+	loc, err := timeLocation(tag)
+	if err != nil {
+		return "", err
+	}
+	if loc != nil {
+		t = t.In(loc)
+	}
+	return t.Format(timeLayouts(tag)[0]), nil
+}
+
+// parseFloat parses cell, a field with a scale tag is divided by the scale
+func parseFloat(cell string, tag reflect.StructTag, bitSize int) (float64, error) {
+	out, err := strconv.ParseFloat(cell, bitSize)
+	if err != nil {
+		return 0, err
+	}
+	if s := tag.Get("scale"); s != "" {
+		scale, err := parseScale(s)
+		if err != nil {
+			return 0, err
+		}
+		out /= scale
+	}
+	if s := tag.Get("round"); s != "" {
+		places, err := strconv.Atoi(s)
+		if err != nil || places < 0 {
+			return 0, fmt.Errorf("round tag %s invalid", s)
+		}
+		pow := math.Pow(10, float64(places))
+		out = math.Round(out*pow) / pow
+	}
+	return out, nil
+}
+
+// plainNumber checks cell is only an optionally signed decimal number, with a
+// fraction and exponent when frac is set, naming anything left after it
+func plainNumber(cell string, frac bool) error {
+	digits := func(i int) int {
+		for i < len(cell) && cell[i] >= '0' && cell[i] <= '9' {
+			i++
+		}
+		return i
+	}
+	i := 0
+	if i < len(cell) && (cell[i] == '+' || cell[i] == '-') {
+		i++
+	}
+	end := digits(i)
+	seen := end > i
+	if frac && end < len(cell) && cell[end] == '.' {
+		next := digits(end + 1)
+		seen = seen || next > end+1
+		end = next
+	}
+	if !seen {
+		return fmt.Errorf("%q is not a number", cell)
+	}
+	if frac && end < len(cell) && (cell[end] == 'e' || cell[end] == 'E') {
+		j := end + 1
+		if j < len(cell) && (cell[j] == '+' || cell[j] == '-') {
+			j++
+		}
+		if k := digits(j); k > j {
+			end = k
+		}
+	}
+	if end < len(cell) {
+		return fmt.Errorf("unexpected %q after the number %s", cell[end:], cell[:end])
+	}
+	return nil
+}
+
+// parseScale reads the value of a scale tag
+func parseScale(s string) (float64, error) {
+	scale, err := strconv.ParseFloat(s, 64)
+	if err != nil || scale == 0 {
+		return 0, fmt.Errorf("scale tag %s invalid", s)
+	}
+	return scale, nil
+}
+
+// boundInt checks n against the min and max tags. With `clamp:"true"` an out
+// of range n is moved to the nearest bound instead of being an error.
+func boundInt(tag reflect.StructTag, n int64) (int64, error) {
+	clamp := tag.Get("clamp") == "true"
+	if s := tag.Get("min"); s != "" {
+		min, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("min tag %s invalid: %s", s, err)
+		}
+		if n < min {
+			if !clamp {
+				return 0, fmt.Errorf("%d is less than min %d", n, min)
+			}
+			n = min
+		}
+	}
+	if s := tag.Get("max"); s != "" {
+		max, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("max tag %s invalid: %s", s, err)
+		}
+		if n > max {
+			if !clamp {
+				return 0, fmt.Errorf("%d is greater than max %d", n, max)
+			}
+			n = max
+		}
+	}
+	return n, nil
+}
+
+// matchEnum returns the value from the comma separated allowed list that cell matches
+func matchEnum(cell string, allowed string, fold bool) (string, error) {
+	for _, a := range strings.Split(allowed, ",") {
+		a = strings.TrimSpace(a)
+		if a == cell || (fold && strings.EqualFold(a, cell)) {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("%q is not one of %s", cell, allowed)
+}
+
+// headerKey is name as compared under match
+func headerKey(name string, match HeaderMatch) string {
+	if match == HeaderMatchNormalized {
+		return strings.ToLower(strings.TrimSpace(name))
+	}
+	return name
+}
+
+// columnNumbers maps each header name, keyed by headerKey, to its index
+func columnNumbers(colHeader []string, match HeaderMatch) map[string]int {
+	colNum := map[string]int{}
+	for i, v := range colHeader {
+		colNum[headerKey(v, match)] = i
+	}
+	return colNum
+}
+
+func getStructTags(T reflect.Type, colHeader []string, opts Options) (map[string]int, error) {
+	if T.Kind() != reflect.Struct && T.Kind() != reflect.Interface {
+		return nil, fmt.Errorf("%s is not a struct", T)
+	}
+
+	colNum := columnNumbers(colHeader, opts.HeaderMatch)
+
+	m, err := mappedColumns(T, colNum, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, fld := range taggedFields(T, "col") {
+		if _, ok := m[fld.Name]; ok || strings.HasPrefix(fld.Tag.Get("col"), restPrefix) || isPseudoColumn(fld.Tag.Get("col")) {
+			continue
+		}
+		n, err := resolveColumn(fld.Tag.Get("col"), colNum, len(colHeader), opts.HeaderMatch)
+		if err != nil {
+			return nil, err
+		}
+		m[fld.Name] = n
+	}
+	if opts.AutoMatchSnakeCase {
+		for k, n := range snakeCaseColumns(T, colHeader, m) {
+			m[k] = n
+		}
+	}
+	return m, nil
+}
+
+// snakeCaseColumns maps each exported field with no col or cols tag, and not
+// already in taken, to the header matching its snake_case name ignoring case.
+// Fields with no such header are left out.
+func snakeCaseColumns(T reflect.Type, colHeader []string, taken map[string]int) map[string]int {
+	colNum := map[string]int{}
+	for i, v := range colHeader {
+		colNum[strings.ToLower(strings.TrimSpace(v))] = i
+	}
+
+	m := map[string]int{}
+	for _, fld := range reflect.VisibleFields(T) {
+		if !fld.IsExported() || fld.Anonymous || fld.Tag.Get("col") != "" || fld.Tag.Get("cols") != "" || !promotedByValue(T, fld.Index, "col") {
+			continue
+		}
+		if _, ok := taken[fld.Name]; ok {
+			continue
+		}
+		if n, ok := colNum[snakeCase(fld.Name)]; ok {
+			m[fld.Name] = n
+		}
+	}
+	return m
+}
+
+// snakeCase turns a Go field name into lower snake case, eg. FirstName is
+// first_name and UserID is user_id
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// mappedColumns maps each field named in opts.ColumnMap to the index of its
+// header, in header order so errors are reported the same way every time
+func mappedColumns(T reflect.Type, colNum map[string]int, opts Options) (map[string]int, error) {
+	headers := make([]string, 0, len(opts.ColumnMap))
+	for h := range opts.ColumnMap {
+		headers = append(headers, h)
+	}
+	sort.Strings(headers)
+
+	m := make(map[string]int)
+	for _, h := range headers {
+		name := opts.ColumnMap[h]
+		if _, ok := T.FieldByName(name); !ok {
+			return nil, fmt.Errorf("mapped field %s does not exist in %s", name, T)
+		}
+		n, ok := colNum[headerKey(h, opts.HeaderMatch)]
+		if !ok {
+			return nil, fmt.Errorf("column %s does not exist", h)
+		}
+		m[name] = n
+	}
+	return m, nil
+}
+
+// restPrefix starts the col tag of a []string field taking every cell from the
+// named column to the end of the row
+const restPrefix = "..."
+
+// getRestTags maps each field tagged `col:"...name"` to the index of the
+// column named after the prefix, the first cell it takes
+func getRestTags(T reflect.Type, colHeader []string, opts Options) (map[string]int, error) {
+	colNum := columnNumbers(colHeader, opts.HeaderMatch)
+	m := map[string]int{}
+	for _, fld := range taggedFields(T, "col") {
+		col, ok := strings.CutPrefix(fld.Tag.Get("col"), restPrefix)
+		if !ok {
+			continue
+		}
+		if fld.Type != reflect.TypeOf([]string(nil)) {
+			return nil, fmt.Errorf("field %s with a %s tag must be a []string", fld.Name, restPrefix)
+		}
+		if len(m) > 0 {
+			return nil, fmt.Errorf("field %s is a second %s field", fld.Name, restPrefix)
+		}
+		n, err := resolveColumn(col, colNum, len(colHeader), opts.HeaderMatch)
+		if err != nil {
+			return nil, err
+		}
+		m[fld.Name] = n
+	}
+	return m, nil
+}
+
+// rawColumn is the col tag of a string field set to the whole row joined back
+// together, quoted where needed
+const rawColumn = "@raw"
+
+// getRawTags lists the fields tagged `col:"@raw"`
+func getRawTags(T reflect.Type) ([]string, error) {
+	names := []string{}
+	for _, fld := range taggedFields(T, "col") {
+		if fld.Tag.Get("col") != rawColumn {
+			continue
+		}
+		if fld.Type.Kind() != reflect.String {
+			return nil, fmt.Errorf("field %s with a %s tag must be a string", fld.Name, rawColumn)
+		}
+		names = append(names, fld.Name)
+	}
+	return names, nil
+}
+
+// hashPrefix starts the col tag of a string field set to a hash of the listed
+// columns, eg. `col:"@hash:name,dob"`
+const hashPrefix = "@hash:"
+
+// isPseudoColumn reports whether a col tag names something other than a
+// column of the file, such fields are never written
+func isPseudoColumn(col string) bool {
+	return col == rawColumn || strings.HasPrefix(col, hashPrefix)
+}
+
+// getHashTags maps each field tagged `col:"@hash:a,b"` to the indexes of the
+// columns it hashes, in tag order
+func getHashTags(T reflect.Type, colHeader []string, match HeaderMatch) (map[string][]int, error) {
+	colNum := columnNumbers(colHeader, match)
+	m := map[string][]int{}
+	for _, fld := range taggedFields(T, "col") {
+		cols, ok := strings.CutPrefix(fld.Tag.Get("col"), hashPrefix)
+		if !ok {
+			continue
+		}
+		if fld.Type.Kind() != reflect.String {
+			return nil, fmt.Errorf("field %s with a %s tag must be a string", fld.Name, hashPrefix)
+		}
+		for _, col := range strings.Split(cols, ",") {
+			n, err := resolveColumn(col, colNum, len(colHeader), match)
+			if err != nil {
+				return nil, err
+			}
+			m[fld.Name] = append(m[fld.Name], n)
+		}
+	}
+	return m, nil
+}
+
+// hashCells is the hex FNV-1a 64 hash of the cells at cols, each followed by a
+// zero byte so "ab","c" and "a","bc" differ. A missing cell hashes as empty.
+func hashCells(row []string, cols []int) string {
+	h := fnv.New64a()
+	for _, n := range cols {
+		if n < len(row) {
+			h.Write([]byte(row[n]))
+		}
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// joinRow writes row as one CSV record separated by comma, without the line
+// break
+func joinRow(row []string, comma rune) string {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Comma = comma
+	w.Write(row)
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// readState is what a read works out for itself on top of its Options
+type readState struct {
+	// interned backs InternStrings for the duration of one read
+	interned map[string]string
+	// quoted tracks the quoting of each column for TypeConsistencyCheck
+	quoted map[int]int
+	// ragged lets rows differ in width, set when T has a rest field
+	ragged bool
+}
+
+// newReadState starts the state of a read into T
+func newReadState[T any]() readState {
+	st := readState{}
+	for _, fld := range taggedFields(reflect.TypeOf(new(T)).Elem(), "col") {
+		if strings.HasPrefix(fld.Tag.Get("col"), restPrefix) {
+			st.ragged = true
+		}
+	}
+	return st
+}
+
+// resolveColumn finds the index of the column a col tag names, by header name
+// first then as a column number counted from 1. A tag such as "3|amount" that
+// is not itself a header lists alternatives tried in order, the first that
+// resolves wins.
+func resolveColumn(col string, colNum map[string]int, width int, match HeaderMatch) (int, error) {
+	if n, ok := colNum[headerKey(col, match)]; ok {
+		return n, nil
+	}
+	if alts := strings.Split(col, "|"); len(alts) > 1 {
+		for _, alt := range alts {
+			if n, err := resolveColumn(alt, colNum, width, match); err == nil {
+				return n, nil
+			}
+		}
+		return 0, fmt.Errorf("no column matches %s", col)
+	}
+	if pos, err := strconv.Atoi(col); err == nil {
+		if pos < 1 || pos > width {
+			return 0, fmt.Errorf("column %d out of range, header has %d columns", pos, width)
+		}
+		return pos - 1, nil
+	}
+	return 0, fmt.Errorf("column %s does not exist", col)
+}
+
+// checkStrictHeader returns every tagged column missing from colHeader and
+// every header column no field reads, joined together
+func checkStrictHeader(T reflect.Type, colHeader []string, opts Options) error {
+	match := opts.HeaderMatch
+	colNum := columnNumbers(colHeader, match)
+	used := map[int]bool{}
+	errs := []error{}
+	mapped := map[string]bool{}
+	for h, name := range opts.ColumnMap {
+		mapped[name] = true
+		if n, ok := colNum[headerKey(h, match)]; ok {
+			used[n] = true
+		}
+	}
+	for _, fld := range taggedFields(T, "col") {
+		if cols, ok := strings.CutPrefix(fld.Tag.Get("col"), hashPrefix); ok {
+			for _, col := range strings.Split(cols, ",") {
+				if n, err := resolveColumn(col, colNum, len(colHeader), match); err != nil {
+					errs = append(errs, err)
+				} else {
+					used[n] = true
+				}
+			}
+			continue
+		}
+		if mapped[fld.Name] || isPseudoColumn(fld.Tag.Get("col")) {
+			continue
+		}
+		col, rest := strings.CutPrefix(fld.Tag.Get("col"), restPrefix)
+		n, err := resolveColumn(col, colNum, len(colHeader), match)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		used[n] = true
+		for i := n; rest && i < len(colHeader); i++ {
+			used[i] = true
+		}
+	}
+	for _, fld := range taggedFields(T, "cols") {
+		for _, col := range strings.Split(fld.Tag.Get("cols"), ",") {
+			n, ok := colNum[headerKey(col, match)]
+			if !ok {
+				errs = append(errs, fmt.Errorf("column %s does not exist", col))
+				continue
+			}
+			used[n] = true
+		}
+	}
+	if opts.AutoMatchSnakeCase {
+		taken := map[string]int{}
+		for name := range mapped {
+			taken[name] = 0
+		}
+		for _, n := range snakeCaseColumns(T, colHeader, taken) {
+			used[n] = true
+		}
+	}
+	for i, v := range colHeader {
+		if !used[i] {
+			errs = append(errs, fmt.Errorf("column %s is not mapped to a field", v))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// getJoinTags maps each string field tagged `cols:"a,b"` to the indexes of its
+// source columns, in tag order
+func getJoinTags(T reflect.Type, colHeader []string, match HeaderMatch) (map[string][]int, error) {
+	colNum := columnNumbers(colHeader, match)
+
+	m := make(map[string][]int)
+	for _, fld := range taggedFields(T, "cols") {
+		cols := fld.Tag.Get("cols")
+		if fld.Type.Kind() != reflect.String {
+			return nil, fmt.Errorf("field %s with cols tag must be a string", fld.Name)
+		}
+		for _, col := range strings.Split(cols, ",") {
+			n, ok := colNum[headerKey(col, match)]
+			if !ok {
+				return nil, fmt.Errorf("column %s does not exist", col)
+			}
+			m[fld.Name] = append(m[fld.Name], n)
+		}
+	}
+	return m, nil
+}
+
+// getStructTagForHeader lists the col tagged fields of T in the order they are
+// written, fields of embedded structs in place of the struct
+func getStructTagForHeader[T any]() ([]reflect.StructField, error) {
+	return headerFields(reflect.TypeOf(new(T)).Elem())
+}
+
+// headerFields is getStructTagForHeader for a type only known at run time
+func headerFields(elem reflect.Type) ([]reflect.StructField, error) {
+	if elem.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%s is not struct", elem)
+	}
+	out := []reflect.StructField{}
+	for _, fld := range taggedFields(elem, "col") {
+		tag := fld.Tag.Get("col")
+		if isPseudoColumn(tag) {
+			continue
+		}
+		if strings.HasPrefix(tag, restPrefix) && fld.Type != reflect.TypeOf([]string(nil)) {
+			return nil, fmt.Errorf("field %s with a %s tag must be a []string", fld.Name, restPrefix)
+		}
+		out = append(out, fld)
+	}
+	return out, nil
+}
+
+// taggedFields lists the fields of T with a non empty tag, in field order,
+// including those promoted from structs embedded by value. A field promoted
+// from a struct embedded by pointer is skipped, as is one hidden by a field
+// of the same name nearer the top, the same as FieldByName. An embedded
+// struct carrying the tag itself is one field, its own fields are not looked
+// at.
+func taggedFields(T reflect.Type, tag string) []reflect.StructField {
+	out := []reflect.StructField{}
+	for _, fld := range reflect.VisibleFields(T) {
+		if fld.Tag.Get(tag) == "" || !promotedByValue(T, fld.Index, tag) {
+			continue
+		}
+		out = append(out, fld)
+	}
+	return out
+}
+
+// promotedByValue reports whether every struct on the path to the field at
+// index is embedded by value and carries no tag of its own
+func promotedByValue(T reflect.Type, index []int, tag string) bool {
+	for i := 1; i < len(index); i++ {
+		parent := T.FieldByIndex(index[:i])
+		if parent.Type.Kind() == reflect.Pointer || parent.Tag.Get(tag) != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,2900 @@
+package csvutil
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"text/template"
+	"time"
+	"unsafe"
+
+	encunicode "golang.org/x/text/encoding/unicode"
+)
+
+// writeFile writes content to a new file in a temporary directory and
+// returns its name
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "test.csv")
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// readFile returns the content of filename
+func readFile(t *testing.T, filename string) string {
+	t.Helper()
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+type Color string
+
+const (
+	Red   Color = "Red"
+	Green Color = "Green"
+	Blue  Color = "Blue"
+)
+
+type enumRow struct {
+	Color Color `col:"color" enum:"Red,Green,Blue"`
+}
+
+func TestEnum(t *testing.T) {
+	rows, err := ReadToStruct[enumRow](writeFile(t, "color\nRed\nBlue\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Color != Red || rows[1].Color != Blue {
+		t.Errorf("got %v", rows)
+	}
+
+	_, err = ReadToStruct[enumRow](writeFile(t, "color\nRed\nPurple\n"))
+	if err == nil || !strings.Contains(err.Error(), `"Purple" is not one of Red,Green,Blue`) {
+		t.Errorf("Purple accepted, err %v", err)
+	}
+}
+
+func TestEnumFold(t *testing.T) {
+	name := writeFile(t, "color\ngreen\nBLUE\n")
+	if _, err := ReadToStruct[enumRow](name); err == nil {
+		t.Error("case mismatch accepted without EnumFold")
+	}
+	rows, err := ReadToStructWithOptions[enumRow](name, Options{EnumFold: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].Color != Green || rows[1].Color != Blue {
+		t.Errorf("got %v, want the spelling from the tag", rows)
+	}
+}
+
+type excelRow struct {
+	Name string `col:"name"`
+	City string `col:"city"`
+}
+
+func TestWriteForExcel(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteForExcel(name, []excelRow{{"Zoë", "Zürich"}, {"Ann", "Oslo"}}); err != nil {
+		t.Fatal(err)
+	}
+	want := "\ufeffname,city\r\nZoë,Zürich\r\nAnn,Oslo\r\n"
+	if got := readFile(t, name); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type continuationRow struct {
+	ID   string `col:"id"`
+	Note string `col:"note"`
+}
+
+func TestContinuation(t *testing.T) {
+	name := writeFile(t, "id,note\n1,first line\n,second line\n2,only\n")
+	rows, err := ReadToStructWithOptions[continuationRow](name, Options{
+		Continuation: func(prev, row []string) bool { return row[0] == "" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []continuationRow{{"1", "first line\nsecond line"}, {"2", "only"}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %q, want %q", rows, want)
+	}
+}
+
+func TestClamp(t *testing.T) {
+	type bounded struct {
+		Score int `col:"score" min:"0" max:"100"`
+	}
+	type clamped struct {
+		Score int `col:"score" min:"0" max:"100" clamp:"true"`
+	}
+	name := writeFile(t, "score\n150\n-5\n42\n")
+
+	rows, err := ReadToStruct[clamped](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []clamped{{100}, {0}, {42}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	_, err = ReadToStruct[bounded](name)
+	if err == nil || !strings.Contains(err.Error(), "150 is greater than max 100") {
+		t.Errorf("150 accepted without clamp, err %v", err)
+	}
+}
+
+type typedRow struct {
+	Name    string    `col:"name"`
+	Count   int       `col:"count"`
+	Price   float64   `col:"price"`
+	Active  bool      `col:"active"`
+	Created time.Time `col:"created"`
+}
+
+func TestWriteTypeRow(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.csv")
+	in := []typedRow{{"a", 1, 2.5, true, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}}
+	if err := WriteFromStructWithOptions(name, in, Options{WriteTypeRow: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := "name,count,price,active,created\nstring,int,float,bool,time\na,1,2.5,true,2024-01-02T03:04:05Z\n"
+	if got := readFile(t, name); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStrictRowWidth(t *testing.T) {
+	name := writeFile(t, "id,note\n1,a\n2\n")
+	if _, err := ReadToStructWithOptions[continuationRow](name, Options{PadShortRows: true}); err != nil {
+		t.Fatalf("short row rejected without StrictRowWidth: %v", err)
+	}
+
+	_, err := ReadToStructWithOptions[continuationRow](name, Options{PadShortRows: true, StrictRowWidth: true})
+	if err == nil || err.Error() != "row 3 has 1 fields, header has 2" {
+		t.Errorf("got %v, want row 3 to violate the width", err)
+	}
+}
+
+func TestPadShortRowsRejectsWideRows(t *testing.T) {
+	name := writeFile(t, "id,note\n1\n2,b,extra\n")
+	_, err := ReadToStructWithOptions[continuationRow](name, Options{PadShortRows: true})
+	if !errors.Is(err, csv.ErrFieldCount) || !strings.Contains(err.Error(), "record on line 3") {
+		t.Errorf("got %v, want line 3 to have too many fields", err)
+	}
+
+	_, err = ReadToStructWithOptions[continuationRow](name, Options{PadShortRows: true, RecordSeparator: '\n'})
+	if err == nil || !strings.Contains(err.Error(), "record 3 has 3 fields, header has 2") {
+		t.Errorf("record separator got %v", err)
+	}
+
+	sr, err := NewStructReaderWithOptions[continuationRow](strings.NewReader("id,note\n1\n2,b,extra\n"), Options{PadShortRows: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sr.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sr.Read(); !errors.Is(err, csv.ErrFieldCount) {
+		t.Errorf("stream got %v", err)
+	}
+
+	name = writeFile(t, "id,values\n1\n2,b,extra\n")
+	rows, err := ReadToStructWithOptions[tailRow](name, Options{PadShortRows: true})
+	if err != nil {
+		t.Fatalf("rest field row rejected: %v", err)
+	}
+	if len(rows) != 2 || !reflect.DeepEqual(rows[1].Values, []string{"b", "extra"}) {
+		t.Errorf("got %v", rows)
+	}
+}
+
+type person struct {
+	First    string `col:"first"`
+	Last     string `col:"last"`
+	FullName string
+}
+
+func TestDerived(t *testing.T) {
+	name := writeFile(t, "first,last\nAda,Lovelace\n")
+	rows, err := ReadToStructWithOptions[person](name, Options{
+		Derived: map[string]func(rec any) (any, error){
+			"FullName": func(rec any) (any, error) {
+				p := rec.(*person)
+				return p.First + " " + p.Last, nil
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].FullName != "Ada Lovelace" {
+		t.Errorf("got %q", rows[0].FullName)
+	}
+}
+
+func TestDerivedUnknownField(t *testing.T) {
+	name := writeFile(t, "first,last\nAda,Lovelace\n")
+	_, err := ReadToStructWithOptions[person](name, Options{
+		Derived: map[string]func(rec any) (any, error){
+			"Age": func(rec any) (any, error) { return 0, nil },
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "derived field Age does not exist") {
+		t.Errorf("got %v", err)
+	}
+}
+
+type amountRow struct {
+	ID     int     `col:"id"`
+	Amount float64 `col:"amount"`
+}
+
+func TestPreValidateTypes(t *testing.T) {
+	name := writeFile(t, "id,amount\n1,9.99\n2,n/a\nx,3\n")
+	_, err := ReadToStructWithOptions[amountRow](name, Options{PreValidateTypes: true})
+	if err == nil {
+		t.Fatal("non numeric amount accepted")
+	}
+	for _, want := range []string{`row 3 column amount: field float Amount invalid: invalid syntax, cell "n/a"`, `row 4 column id:`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q does not report %q", err, want)
+		}
+	}
+}
+
+type splitRow struct {
+	Name string `col:"name"`
+	Qty  int    `col:"qty"`
+}
+
+func TestReadToStructWithSplitter(t *testing.T) {
+	re := regexp.MustCompile(`\s*\|\s*`)
+	split := func(line string) []string { return re.Split(line, -1) }
+
+	name := writeFile(t, "name | qty\r\n\r\nbolt|12\nnut  |  7")
+	rows, err := ReadToStructWithSplitter[splitRow](name, split)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []splitRow{{"bolt", 12}, {"nut", 7}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
+
+func TestReadToStructWithSplitterLongLine(t *testing.T) {
+	long := strings.Repeat("x", 100<<10)
+	name := writeFile(t, "name|qty\n"+long+"|1\n")
+	rows, err := ReadToStructWithSplitter[splitRow](name, func(line string) []string {
+		return strings.Split(line, "|")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Name != long {
+		t.Errorf("long line not read whole")
+	}
+}
+
+type suffixRow struct {
+	Latency int `col:"latency" suffix:"ms"`
+	Size    int `col:"size" suffix:"B,KB"`
+}
+
+func TestSuffix(t *testing.T) {
+	rows, err := ReadToStruct[suffixRow](writeFile(t, "latency,size\n1500ms,2KB\n20ms,512B\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []suffixRow{{1500, 2}, {20, 512}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(name, rows[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "latency,size\n1500ms,2B\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type unexportedRow struct {
+	name string `col:"name"`
+}
+
+func TestRecoverPanics(t *testing.T) {
+	name := writeFile(t, "name\nada\n")
+	_, err := ReadToStructWithOptions[unexportedRow](name, Options{RecoverPanics: true})
+	if err == nil || !strings.Contains(err.Error(), "row 2: panic during conversion") {
+		t.Errorf("got %v, want the panic as a row error", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("setting an unexported field did not panic without RecoverPanics")
+		}
+	}()
+	ReadToStruct[unexportedRow](name)
+}
+
+func TestWriteFromStructMulti(t *testing.T) {
+	dir := t.TempDir()
+	csvName, tsvName := filepath.Join(dir, "out.csv"), filepath.Join(dir, "out.tsv")
+	in := []excelRow{{"Ann", "Oslo, NO"}}
+	if err := WriteFromStructMulti(in, map[string]rune{csvName: ',', tsvName: '\t'}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, csvName), "name,city\nAnn,\"Oslo, NO\"\n"; got != want {
+		t.Errorf("csv got %q, want %q", got, want)
+	}
+	if got, want := readFile(t, tsvName), "name\tcity\nAnn\tOslo, NO\n"; got != want {
+		t.Errorf("tsv got %q, want %q", got, want)
+	}
+}
+
+func TestWriteFromStructMultiBadDelimiter(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStructMulti([]excelRow{}, map[string]rune{name: '"'}); err == nil {
+		t.Error("quote accepted as a delimiter")
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Error("file written despite the bad delimiter")
+	}
+}
+
+func TestWriteFromStructMultiWrapsErrors(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "missing", "out.csv")
+	err := WriteFromStructMulti([]excelRow{}, map[string]rune{name: ','})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want it to wrap fs.ErrNotExist", err)
+	}
+}
+
+type jsonRow struct {
+	ID       int            `col:"id"`
+	Metadata map[string]any `col:"metadata" json:"true"`
+}
+
+func TestJSONCell(t *testing.T) {
+	name := writeFile(t, "id,metadata\n1,\"{\"\"source\"\":\"\"web\"\",\"\"tries\"\":2}\"\n2,\n")
+	rows, err := ReadToStruct[jsonRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []jsonRow{{1, map[string]any{"source": "web", "tries": 2.0}}, {2, nil}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got %v, want %v", rows, want)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(out, rows); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, out); got != readFile(t, name) {
+		t.Errorf("round trip gave %q", got)
+	}
+}
+
+func TestNormalizeUnicodeSpace(t *testing.T) {
+	name := writeFile(t, "id,amount\n\u00a01\u00a0,\u00a012.5\u2003\n")
+	if _, err := ReadToStruct[amountRow](name); err == nil {
+		t.Error("non breaking spaces accepted without NormalizeUnicodeSpace")
+	}
+	rows, err := ReadToStructWithOptions[amountRow](name, Options{NormalizeUnicodeSpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{1, 12.5}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
+
+func TestAppendColumn(t *testing.T) {
+	in := writeFile(t, "id,amount\n1,2.5\n2,4\n")
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := AppendColumn(in, out, "double", []string{"5", "8"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "id,amount,double\n1,2.5,5\n2,4,8\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	err := AppendColumn(in, out, "double", []string{"5"})
+	if err == nil || err.Error() != "got 1 values for 2 data rows" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDecodeBOM(t *testing.T) {
+	content := "name,city\nZoë,Zürich\n"
+	tests := []struct {
+		name  string
+		order encunicode.Endianness
+	}{
+		{"UTF-16LE", encunicode.LittleEndian},
+		{"UTF-16BE", encunicode.BigEndian},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := encunicode.UTF16(tt.order, encunicode.UseBOM).NewEncoder().String(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, err := ReadToStruct[excelRow](writeFile(t, encoded))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []excelRow{{"Zoë", "Zürich"}}; !reflect.DeepEqual(rows, want) {
+				t.Errorf("got %v, want %v", rows, want)
+			}
+		})
+	}
+
+	rows, err := ReadToStruct[excelRow](writeFile(t, "\ufeff"+content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].Name != "Zoë" {
+		t.Errorf("UTF-8 BOM not stripped, got %q", rows[0].Name)
+	}
+}
+
+type subscriptionRow struct {
+	Email      string `col:"email"`
+	Subscribed bool   `col:"subscribed" true:"opt-in,yes" false:"opt-out"`
+}
+
+func TestBoolLiterals(t *testing.T) {
+	rows, err := ReadToStruct[subscriptionRow](writeFile(t, "email,subscribed\na@x,opt-in\nb@x,opt-out\nc@x,yes\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []subscriptionRow{{"a@x", true}, {"b@x", false}, {"c@x", true}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	_, err = ReadToStruct[subscriptionRow](writeFile(t, "email,subscribed\na@x,true\n"))
+	if err == nil || !strings.Contains(err.Error(), `"true" is not one of true "opt-in,yes" or false "opt-out"`) {
+		t.Errorf("unlisted value accepted, err %v", err)
+	}
+
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(name, rows); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "email,subscribed\na@x,opt-in\nb@x,opt-out\nc@x,opt-in\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadToStructPartial(t *testing.T) {
+	name := writeFile(t, "id,amount\n1,9.99\n2,oops\n3,1\nx,2\n")
+	rows, failed, errs, err := ReadToStructPartial[amountRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{1, 9.99}, {3, 1}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows %v, want %v", rows, want)
+	}
+	if want := [][]string{{"2", "oops"}, {"x", "2"}}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed %v, want %v", failed, want)
+	}
+	if len(errs) != 2 || !strings.HasPrefix(errs[0].Error(), "row 3: ") || !strings.HasPrefix(errs[1].Error(), "row 5: ") {
+		t.Errorf("errs %v", errs)
+	}
+
+	if _, _, _, err := ReadToStructPartial[amountRow](writeFile(t, "id,total\n1,2\n")); err == nil {
+		t.Error("header not matching T is not fatal")
+	}
+}
+
+type sensorRow struct {
+	Temperature float64 `col:"temperature" scale:"100"`
+}
+
+func TestScale(t *testing.T) {
+	rows, err := ReadToStruct[sensorRow](writeFile(t, "temperature\n2537\n-12\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []sensorRow{{25.37}, {-0.12}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(name, rows); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "temperature\n2537\n-12\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.csv")
+	in := []amountRow{{1, 9.99}, {2, 5}}
+	if err := WriteFromStructWithOptions(name, in, Options{WriteChecksum: true}); err != nil {
+		t.Fatal(err)
+	}
+	content := readFile(t, name)
+	if !strings.Contains(content, "\n#sha256:") {
+		t.Fatalf("no trailer in %q", content)
+	}
+
+	rows, err := ReadToStructWithOptions[amountRow](name, Options{VerifyChecksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rows, in) {
+		t.Errorf("got %v, want %v", rows, in)
+	}
+
+	tampered := writeFile(t, strings.Replace(content, "9.99", "9.98", 1))
+	_, err = ReadToStructWithOptions[amountRow](tampered, Options{VerifyChecksum: true})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("tampering not detected, err %v", err)
+	}
+}
+
+func BenchmarkWriteChecksum(b *testing.B) {
+	in := make([]amountRow, 10000)
+	for i := range in {
+		in[i] = amountRow{i, float64(i) / 8}
+	}
+	for _, checksum := range []bool{false, true} {
+		b.Run(fmt.Sprintf("WriteChecksum=%t", checksum), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				if err := EncodeToWriterWithOptions(io.Discard, in, Options{WriteChecksum: checksum}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type revenueRow struct {
+	Region  string  `col:"region"`
+	Revenue float64 `col:"Revenue, USD"`
+}
+
+func TestQuotedHeaderWithDelimiter(t *testing.T) {
+	rows, err := ReadToStruct[revenueRow](writeFile(t, "region,\"Revenue, USD\"\nEU,12.5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []revenueRow{{"EU", 12.5}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
+
+func TestMaxRows(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("id,amount\n")
+	for i := 1; i <= 20; i++ {
+		fmt.Fprintf(&b, "%d,%d\n", i, i*10)
+	}
+	name := writeFile(t, b.String())
+
+	rows, err := ReadToStructWithOptions[amountRow](name, Options{MaxRows: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 5 || rows[4].ID != 5 {
+		t.Errorf("got %v, want the first 5 rows", rows)
+	}
+
+	// a row skipped by OnError is not one of the MaxRows returned
+	bad := writeFile(t, "id,amount\n1,1\nx,2\n3,3\n4,4\n")
+	rows, err = ReadToStructWithOptions[amountRow](bad, Options{
+		MaxRows: 3,
+		OnError: func(row int, err error) bool { return true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{1, 1}, {3, 3}, {4, 4}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
+
+type flagRow struct {
+	ID      int  `col:"id"`
+	Flagged bool `col:"flagged" boolmode:"presence" true:"x"`
+}
+
+func TestBoolPresence(t *testing.T) {
+	rows, err := ReadToStruct[flagRow](writeFile(t, "id,flagged\n1,x\n2,\n3,anything\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []flagRow{{1, true}, {2, false}, {3, true}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(name, rows[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "id,flagged\n1,x\n2,\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTrimQuotes(t *testing.T) {
+	rows, err := ReadToStructWithOptions[amountRow](writeFile(t, "id,amount\n“1”,«2.5»\n"), Options{TrimQuotes: "“”«»"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{1, 2.5}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
+
+type regionRow struct {
+	Region string `col:"region"`
+	Sales  int    `col:"sales"`
+}
+
+func TestWriteFromStructPartitioned(t *testing.T) {
+	dir := t.TempDir()
+	in := []regionRow{{"eu", 1}, {"us", 2}, {"eu", 3}, {"apac", 4}}
+	files, err := WriteFromStructPartitioned(dir, in, func(r regionRow) string { return r.Region })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"eu":   "region,sales\neu,1\neu,3\n",
+		"us":   "region,sales\nus,2\n",
+		"apac": "region,sales\napac,4\n",
+	}
+	if len(files) != len(want) {
+		t.Fatalf("got %v", files)
+	}
+	for key, content := range want {
+		if files[key] != filepath.Join(dir, key+".csv") {
+			t.Errorf("%s written to %s", key, files[key])
+		}
+		if got := readFile(t, files[key]); got != content {
+			t.Errorf("%s got %q, want %q", key, got, content)
+		}
+	}
+
+	if _, err := WriteFromStructPartitioned(dir, []regionRow{{"../x", 1}}, func(r regionRow) string { return r.Region }); err == nil {
+		t.Error("key with a path separator accepted")
+	}
+}
+
+// badRows is a file of n rows whose amount does not parse
+func badRows(n int) string {
+	var b strings.Builder
+	b.WriteString("id,amount\n")
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "%d,bad%d\n", i, i)
+	}
+	return b.String()
+}
+
+func TestMaxErrors(t *testing.T) {
+	name := writeFile(t, badRows(15))
+	_, failed, errs, err := ReadToStructPartialWithOptions[amountRow](name, Options{MaxErrors: 10})
+	if !errors.Is(err, ErrTooManyErrors) {
+		t.Fatalf("got %v, want ErrTooManyErrors", err)
+	}
+	if len(errs) != 10 || len(failed) != 10 {
+		t.Errorf("got %d errors and %d failed rows, want 10", len(errs), len(failed))
+	}
+
+	// the limit is hit by the last row of the file
+	_, _, errs, err = ReadToStructPartialWithOptions[amountRow](writeFile(t, badRows(10)), Options{MaxErrors: 10})
+	if !errors.Is(err, ErrTooManyErrors) || len(errs) != 10 {
+		t.Errorf("got %d errors and %v, want 10 and ErrTooManyErrors", len(errs), err)
+	}
+
+	_, rowErrs, err := ReadToStructCollectWithOptions[amountRow](name, Options{MaxErrors: 10})
+	if !errors.Is(err, ErrTooManyErrors) || len(rowErrs) != 10 {
+		t.Errorf("collect got %d errors and %v, want 10 and ErrTooManyErrors", len(rowErrs), err)
+	}
+
+	_, err = ReadToStructWithOptions[amountRow](name, Options{PreValidateTypes: true, MaxErrors: 10})
+	if !errors.Is(err, ErrTooManyErrors) || strings.Count(err.Error(), "invalid syntax") != 10 {
+		t.Errorf("pre-validation got %v", err)
+	}
+}
+
+type Attributes map[string]string
+
+type attrRow struct {
+	ID    int            `col:"id"`
+	Attrs Attributes     `col:"attrs" sep:";"`
+	Ports map[string]int `col:"ports" sep:"," kv:":"`
+}
+
+func TestMapField(t *testing.T) {
+	rows, err := ReadToStruct[attrRow](writeFile(t, "id,attrs,ports\n1,k1=v1;k2=v2,\"http:80,https:443\"\n2,,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []attrRow{
+		{1, Attributes{"k1": "v1", "k2": "v2"}, map[string]int{"http": 80, "https": 443}},
+		{2, nil, nil},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got %v, want %v", rows, want)
+	}
+
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(name, rows); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "id,attrs,ports\n1,k1=v1;k2=v2,\"http:80,https:443\"\n2,,\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err = ReadToStruct[attrRow](writeFile(t, "id,attrs,ports\n1,k1,\n"))
+	if err == nil || !strings.Contains(err.Error(), `"k1" has no "="`) {
+		t.Errorf("pair without = accepted, err %v", err)
+	}
+}
+
+type measureRow struct {
+	Value float64 `col:"value"`
+	Exact float64 `col:"exact" fmt:"f" prec:"2"`
+}
+
+func TestFloatFormat(t *testing.T) {
+	in := []measureRow{{1234.5678, 0.1}}
+	two := 2
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"default", Options{}, "1234.5678,0.10"},
+		{"e", Options{FloatFormat: 'e'}, "1.2345678e+03,0.10"},
+		{"e with precision", Options{FloatFormat: 'e', FloatPrecision: &two}, "1.23e+03,0.10"},
+		{"g", Options{FloatFormat: 'g'}, "1234.5678,0.10"},
+		{"g with precision", Options{FloatFormat: 'g', FloatPrecision: &two}, "1.2e+03,0.10"},
+		{"precision alone", Options{FloatPrecision: &two}, "1234.57,0.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "out.csv")
+			if err := WriteFromStructWithOptions(name, in, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := readFile(t, name), "value,exact\n"+tt.want+"\n"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+type lowerRow struct {
+	Name  string `col:"name"`
+	Color Color  `col:"color" enum:"Red,Green,Blue"`
+	Count int    `col:"count"`
+}
+
+func TestLowercaseStrings(t *testing.T) {
+	rows, err := ReadToStructWithOptions[lowerRow](writeFile(t, "name,color,count\nMiXeD Case,Red,0042\n"), Options{LowercaseStrings: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []lowerRow{{"mixed case", Red, 42}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
+
+type scoresRow struct {
+	Scores []int `col:"scores" sep:","`
+}
+
+func TestIntSlice(t *testing.T) {
+	rows, err := ReadToStruct[scoresRow](writeFile(t, "scores\n\"90,85,77\"\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []scoresRow{{[]int{90, 85, 77}}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	_, err = ReadToStruct[scoresRow](writeFile(t, "scores\n\"90,x,77\"\n"))
+	if err == nil || !strings.Contains(err.Error(), "field slice Scores element 1 invalid") {
+		t.Errorf("got %v, want the bad element named", err)
+	}
+}
+
+type nullRow struct {
+	Ptr   *float64 `col:"ptr"`
+	Value float64  `col:"value"`
+}
+
+func TestNullString(t *testing.T) {
+	one := 1.5
+	in := []nullRow{{nil, math.NaN()}, {&one, 2}}
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStructWithOptions(name, in, Options{NullString: "NULL", NaNAsNull: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "ptr,value\nNULL,NULL\n1.5,2\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := WriteFromStructWithOptions(name, in, Options{NullString: "NULL"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "ptr,value\nNULL,NaN\n1.5,2\n"; got != want {
+		t.Errorf("without NaNAsNull got %q, want %q", got, want)
+	}
+}
+
+type markRow struct {
+	ID  int  `col:"id"`
+	Yes bool `col:"yes" boolmode:"mark"`
+}
+
+func TestBoolMark(t *testing.T) {
+	rows, err := ReadToStruct[markRow](writeFile(t, "id,yes\n1,✓\n2,\n3,X\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []markRow{{1, true}, {2, false}, {3, true}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	_, err = ReadToStruct[markRow](writeFile(t, "id,yes\n1,no\n"))
+	if err == nil || !strings.Contains(err.Error(), `"no" is not a check mark or blank`) {
+		t.Errorf("got %v", err)
+	}
+}
+
+// failOpen makes openFile fail with err the first n calls, counting every call
+func failOpen(t *testing.T, n int, err error) *int {
+	t.Helper()
+	calls := 0
+	orig := openFile
+	openFile = func(name string) (*os.File, error) {
+		calls++
+		if calls <= n {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		return orig(name)
+	}
+	t.Cleanup(func() { openFile = orig })
+	return &calls
+}
+
+func TestRetryOpen(t *testing.T) {
+	name := writeFile(t, "id,amount\n1,2\n")
+	calls := failOpen(t, 2, syscall.EAGAIN)
+	rows, err := ReadToStructWithOptions[amountRow](name, Options{RetryOpen: 3, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 3 || len(rows) != 1 {
+		t.Errorf("got %d opens and %v", *calls, rows)
+	}
+
+	*calls = 0
+	if _, err := ReadToStructWithOptions[amountRow](name, Options{RetryOpen: 1}); !errors.Is(err, syscall.EAGAIN) {
+		t.Errorf("got %v, want the open error once the retries run out", err)
+	}
+	if *calls != 2 {
+		t.Errorf("got %d opens, want 2", *calls)
+	}
+}
+
+func TestRetryOpenNotExist(t *testing.T) {
+	calls := failOpen(t, 0, nil)
+	_, err := ReadToStructWithOptions[amountRow](filepath.Join(t.TempDir(), "missing.csv"), Options{RetryOpen: 5})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("missing file opened %d times, want 1", *calls)
+	}
+}
+
+type zonedRow struct {
+	At time.Time `col:"at" time:"2006-01-02 15:04" tz:"America/New_York"`
+}
+
+func TestTimeZoneTag(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	rows, err := ReadToStruct[zonedRow](writeFile(t, "at\n2024-07-01 09:30\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2024, 7, 1, 9, 30, 0, 0, ny)
+	if !rows[0].At.Equal(want) || rows[0].At.Location().String() != "America/New_York" {
+		t.Errorf("got %v, want %v", rows[0].At, want)
+	}
+
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(name, []zonedRow{{want.UTC()}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "at\n2024-07-01 09:30\n"; got != want {
+		t.Errorf("got %q, want the time written in the tz location", got)
+	}
+}
+
+type paddedRow struct {
+	ID    string `col:"id" required:"true"`
+	Name  string `col:"name"`
+	City  string `col:"city"`
+	Score int    `col:"score"`
+}
+
+func TestPadShortRows(t *testing.T) {
+	name := writeFile(t, "id,name,city,score\n1,Ann,Oslo,3\n2,Bob\n3\n")
+	rows, err := ReadToStructWithOptions[paddedRow](name, Options{PadShortRows: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []paddedRow{{"1", "Ann", "Oslo", 3}, {"2", "Bob", "", 0}, {"3", "", "", 0}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	if _, err := ReadToStruct[paddedRow](name); err == nil {
+		t.Error("short rows accepted without PadShortRows")
+	}
+
+	_, err = ReadToStructWithOptions[paddedRow](writeFile(t, "name,city,score,id\nAnn\n"), Options{PadShortRows: true})
+	if err == nil || !strings.Contains(err.Error(), "field ID column 3 missing, row has 1 fields") {
+		t.Errorf("missing required cell accepted, err %v", err)
+	}
+}
+
+type eventRow struct {
+	Name string    `col:"name"`
+	At   time.Time `col:"at" time:"2006-01-02"`
+}
+
+func TestZeroTimeAsNull(t *testing.T) {
+	in := []eventRow{{"set", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}, {"unset", time.Time{}}}
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStructWithOptions(name, in, Options{ZeroTimeAsNull: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "name,at\nset,2024-03-01\nunset,\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := WriteFromStructWithOptions(name, in, Options{ZeroTimeAsNull: true, NullString: "N/A"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "name,at\nset,2024-03-01\nunset,N/A\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type priceRow struct {
+	Price    float64 `col:"price"`
+	Discount float64 `col:"discount"`
+}
+
+func TestCurrencyAndPercentColumns(t *testing.T) {
+	name := writeFile(t, "price,discount\n\"$1,234.50\",12.5%\n$ 3,7 %\n")
+	rows, err := ReadToStructWithOptions[priceRow](name, Options{
+		CurrencyColumns: map[string]string{"price": "$"},
+		PercentColumns:  map[string]bool{"discount": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []priceRow{{1234.50, 12.5}, {3, 7}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	if _, err := ReadToStruct[priceRow](name); err == nil {
+		t.Error("currency and percent cells accepted without the options")
+	}
+}
+
+type sourcedRow struct {
+	ID     int `col:"id"`
+	Source string
+}
+
+func TestSourceColumnGlob(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"a.csv": "id\n1\n2\n", "b.csv": "id\n3\n", "c.txt": "id\n9\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := ReadToStructGlob[sourcedRow](filepath.Join(dir, "*.csv"), Options{SourceColumn: "Source"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := filepath.Join(dir, "a.csv"), filepath.Join(dir, "b.csv")
+	if want := []sourcedRow{{1, a}, {2, a}, {3, b}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	_, err = ReadToStructWithOptions[sourcedRow](a, Options{SourceColumn: "ID"})
+	if err == nil || err.Error() != "source field ID is not a string field" {
+		t.Errorf("got %v", err)
+	}
+}
+
+type populationRow struct {
+	Population int  `col:"population" group:","`
+	Area       uint `col:"area" group:"."`
+}
+
+func TestGroupDigits(t *testing.T) {
+	in := []populationRow{{1234567, 9876}, {-1000, 12}, {999, 0}}
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(name, in); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "population,area\n\"1,234,567\",9.876\n\"-1,000\",12\n999,0\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	back, err := ReadToStruct[populationRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, in) {
+		t.Errorf("round trip got %v", back)
+	}
+}
+
+type Item struct {
+	K int `json:"k"`
+}
+
+type itemsRow struct {
+	Items []Item `col:"items" json:"true"`
+}
+
+func TestJSONArrayCell(t *testing.T) {
+	rows, err := ReadToStruct[itemsRow](writeFile(t, "items\n\"[{\"\"k\"\":1},{\"\"k\"\":2}]\"\n\"\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []itemsRow{{[]Item{{1}, {2}}}, {nil}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	_, err = ReadToStruct[itemsRow](writeFile(t, "items\n[1\n"))
+	if err == nil || !strings.Contains(err.Error(), "field json Items invalid") {
+		t.Errorf("got %v", err)
+	}
+}
+
+type whenRow struct {
+	When time.Time `col:"when" time:"2006-01-02|2006-01-02 15:04:05"`
+}
+
+func TestTimeLayouts(t *testing.T) {
+	rows, err := ReadToStruct[whenRow](writeFile(t, "when\n2023-01-02\n2023-01-02 15:04:05\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []whenRow{
+		{time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	if _, err := ReadToStruct[whenRow](writeFile(t, "when\n02/01/2023\n")); err == nil {
+		t.Error("cell matching no layout accepted")
+	}
+}
+
+func TestDecodeEncodeStreams(t *testing.T) {
+	rows, err := DecodeFromReader[amountRow](strings.NewReader("id,amount\n1,9.99\n2,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{1, 9.99}, {2, 5}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	var b strings.Builder
+	if err := EncodeToWriterWithOptions(&b, rows, Options{Comma: ';'}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "id;amount\n1;9.99\n2;5\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	b.Reset()
+	err = EncodeToWriterWithOptions(&b, []excelRow{{"\xff", ""}}, Options{ValidateUTF8: true})
+	if err == nil || b.Len() != 0 {
+		t.Errorf("got %v and %q, want an error and no output", err, b.String())
+	}
+}
+
+func TestComputedColumns(t *testing.T) {
+	var b strings.Builder
+	err := EncodeToWriterWithOptions(&b, []person{{First: "Ada", Last: "Lovelace"}}, Options{
+		ComputedColumns: []ComputedColumn{{Header: "full_name", Value: func(rec any) string {
+			p := rec.(person)
+			return p.First + " " + p.Last
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "first,last,full_name\nAda,Lovelace,Ada Lovelace\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type inferredRow struct {
+	ID    string `col:"id"`
+	Count string `col:"count"`
+	Price string `col:"price"`
+}
+
+func TestTypeConsistencyCheck(t *testing.T) {
+	opts := Options{TypeConsistencyCheck: true}
+	if _, err := ReadToStructWithOptions[inferredRow](writeFile(t, "id,count,price\na,1,2.5\nb,2,3\n"), opts); err != nil {
+		t.Errorf("consistent file rejected: %v", err)
+	}
+
+	_, err := ReadToStructWithOptions[inferredRow](writeFile(t, "id,count,price\na,1,2.5\nb,2,3\nc,many,4\n"), opts)
+	if err == nil || err.Error() != `row 4 column count: "many" is string, first row is int` {
+		t.Errorf("got %v", err)
+	}
+
+	_, err = ReadToStructWithOptions[inferredRow](writeFile(t, "id,count,price\na,1,2.5\nb,2.5,3\n"), opts)
+	if err == nil || err.Error() != `row 3 column count: "2.5" is float, first row is int` {
+		t.Errorf("got %v", err)
+	}
+}
+
+type floatRow struct {
+	F32 float32 `col:"f32"`
+	F64 float64 `col:"f64"`
+}
+
+func TestFloatRoundTrip(t *testing.T) {
+	in := []floatRow{{3.14159, 2.718281828459045}, {-0.5, 1e-7}, {1, 123456.789}}
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(name, in); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, name); !strings.Contains(got, "3.14159,2.718281828459045\n") {
+		t.Errorf("fractions lost in %q", got)
+	}
+
+	back, err := ReadToStruct[floatRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range in {
+		if math.Abs(float64(back[i].F32-in[i].F32)) > 1e-6 || math.Abs(back[i].F64-in[i].F64) > 1e-12 {
+			t.Errorf("row %d got %v, want %v", i, back[i], in[i])
+		}
+	}
+}
+
+type phoneRow struct {
+	Name  string `col:"name"`
+	Phone string `cols:"area_code,number" join:"-"`
+}
+
+func TestJoinColumns(t *testing.T) {
+	rows, err := ReadToStruct[phoneRow](writeFile(t, "name,area_code,number\nAnn,555,0100\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []phoneRow{{"Ann", "555-0100"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	_, err = ReadToStruct[phoneRow](writeFile(t, "name,area_code\nAnn,555\n"))
+	if err == nil || !strings.Contains(err.Error(), "column number does not exist") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	empty := writeFile(t, "")
+	if _, err := ReadToStruct[amountRow](empty); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("ReadToStruct got %v", err)
+	}
+	if _, _, _, err := ReadToStructPartial[amountRow](empty); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("ReadToStructPartial got %v", err)
+	}
+	if _, _, err := ReadToStructCollect[amountRow](empty); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("ReadToStructCollect got %v", err)
+	}
+	if _, err := OpenCursor[amountRow](empty); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("OpenCursor got %v", err)
+	}
+	if err := AppendColumn(empty, filepath.Join(t.TempDir(), "out.csv"), "x", nil); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("AppendColumn got %v", err)
+	}
+}
+
+func TestHeaderOnly(t *testing.T) {
+	rows, err := ReadToStruct[amountRow](writeFile(t, "id,amount\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows == nil || len(rows) != 0 {
+		t.Errorf("got %#v, want an empty slice", rows)
+	}
+}
+
+func TestCommaAndComment(t *testing.T) {
+	name := writeFile(t, "# exported by the billing system\nid;amount\n1;9.99\n# total follows\n2;5\n")
+	rows, err := ReadToStructWithOptions[amountRow](name, Options{Comma: ';', Comment: '#'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{1, 9.99}, {2, 5}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.tsv")
+	if err := WriteFromStructWithOptions(out, rows, Options{Comma: '\t'}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "id\tamount\n1\t9.99\n2\t5\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type fullNameRow struct {
+	ID       int    `col:"id"`
+	FullName string `col:"full_name"`
+}
+
+func TestExpandFields(t *testing.T) {
+	var b strings.Builder
+	split := FieldExpander{Headers: []string{"first", "last"}, Split: func(v any) []string {
+		first, last, _ := strings.Cut(v.(string), " ")
+		return []string{first, last}
+	}}
+	err := EncodeToWriterWithOptions(&b, []fullNameRow{{1, "Ada Lovelace"}}, Options{ExpandFields: map[string]FieldExpander{"FullName": split}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "id,first,last\n1,Ada,Lovelace\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	bad := FieldExpander{Headers: []string{"first", "last"}, Split: func(v any) []string { return []string{"x"} }}
+	err = EncodeToWriterWithOptions(&b, []fullNameRow{{1, "Ada"}}, Options{ExpandFields: map[string]FieldExpander{"FullName": bad}})
+	if err == nil || err.Error() != "expanded field FullName gave 1 columns, expected 2" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestRecordSeparator(t *testing.T) {
+	name := writeFile(t, "id,note|1,\"a, b\"|2,\"two\nlines\"|\n")
+	rows, err := ReadToStructWithOptions[continuationRow](name, Options{RecordSeparator: '|'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []continuationRow{{"1", "a, b"}, {"2", "two\nlines"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %q, want %q", rows, want)
+	}
+
+	_, err = ReadToStructWithOptions[continuationRow](name, Options{RecordSeparator: ','})
+	if err == nil || !strings.Contains(err.Error(), "record separator ',' invalid") {
+		t.Errorf("got %v", err)
+	}
+}
+
+type dateRow struct {
+	Day     time.Time `col:"day" time:"2006-01-02"`
+	Created time.Time `col:"created"`
+}
+
+func TestTimeField(t *testing.T) {
+	name := writeFile(t, "day,created\n2024-02-29,2024-02-29T10:00:00+02:00\n,\n")
+	rows, err := ReadToStruct[dateRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows[0].Day.Equal(time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)) || !rows[0].Created.Equal(time.Date(2024, 2, 29, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %v", rows[0])
+	}
+	if !rows[1].Day.IsZero() || !rows[1].Created.IsZero() {
+		t.Errorf("empty cells got %v, want zero times", rows[1])
+	}
+
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(out, rows[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "day,created\n2024-02-29,2024-02-29T10:00:00+02:00\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err = ReadToStruct[dateRow](writeFile(t, "day,created\n29/02/2024,\n"))
+	if err == nil || !strings.Contains(err.Error(), "field time Day invalid") {
+		t.Errorf("got %v", err)
+	}
+}
+
+type ledgerRow struct {
+	Amount float64 `col:"amount"`
+	Units  int     `col:"units"`
+}
+
+func TestAccountingNegatives(t *testing.T) {
+	name := writeFile(t, "amount,units\n\"(1,234.50)\",(12)\n7.5,3\n")
+	rows, err := ReadToStructWithOptions[ledgerRow](name, Options{AccountingNegatives: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []ledgerRow{{-1234.50, -12}, {7.5, 3}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	rows, err = ReadToStructWithOptions[ledgerRow](writeFile(t, "amount,units\n\"($1,234.50)\",1\n"), Options{
+		AccountingNegatives: true,
+		CurrencyColumns:     map[string]string{"amount": "$"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].Amount != -1234.50 {
+		t.Errorf("with currency got %v", rows[0].Amount)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStructWithOptions(out, []ledgerRow{{-3.25, -4}}, Options{AccountingNegatives: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "amount,units\n(3.25),(4)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type uintRow struct {
+	ID    uint32 `col:"id"`
+	Count uint64 `col:"count"`
+	Big   int64  `col:"big"`
+}
+
+func TestUintFields(t *testing.T) {
+	name := writeFile(t, "id,count,big\n4294967295,18446744073709551615,9223372036854775807\n")
+	rows, err := ReadToStruct[uintRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uintRow{{math.MaxUint32, math.MaxUint64, math.MaxInt64}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(out, rows); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, out); got != readFile(t, name) {
+		t.Errorf("got %q", got)
+	}
+
+	for _, cell := range []string{"-1", "4294967296"} {
+		if _, err := ReadToStruct[uintRow](writeFile(t, "id,count,big\n"+cell+",0,0\n")); err == nil {
+			t.Errorf("%s accepted into a uint32", cell)
+		}
+	}
+}
+
+func TestEmptyHeaders(t *testing.T) {
+	name := writeFile(t, "name,city,\nAda,London,x\n")
+	rows, err := ReadToStruct[excelRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []excelRow{{"Ada", "London"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	_, err = ReadToStructWithOptions[excelRow](name, Options{EmptyHeaders: EmptyHeaderError})
+	if err == nil || !strings.Contains(err.Error(), "header column 3 has no name") {
+		t.Errorf("got %v", err)
+	}
+
+	type namedRow struct {
+		Name  string `col:"name"`
+		Extra string `col:"column_3"`
+	}
+	named, err := ReadToStructWithOptions[namedRow](name, Options{EmptyHeaders: EmptyHeaderName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []namedRow{{"Ada", "x"}}; !reflect.DeepEqual(named, want) {
+		t.Errorf("got %v, want %v", named, want)
+	}
+}
+
+type jobRow struct {
+	Name    string        `col:"name"`
+	Elapsed time.Duration `col:"elapsed"`
+}
+
+func TestDurationFields(t *testing.T) {
+	in := []jobRow{{"build", 90 * time.Minute}}
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStructWithOptions(out, in, Options{WriteTypeRow: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "name,elapsed\nstring,duration\nbuild,1h30m0s\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	opts := Options{DurationUnit: time.Second}
+	if err := WriteFromStructWithOptions(out, in, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "name,elapsed\nbuild,5400\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	rows, err := ReadToStructWithOptions[jobRow](out, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rows, in) {
+		t.Errorf("got %v, want %v", rows, in)
+	}
+}
+
+type optionalRow struct {
+	ID    *int    `col:"id"`
+	Label *string `col:"label"`
+}
+
+func TestPointerFields(t *testing.T) {
+	name := writeFile(t, "id,label\n0,\n,x\n")
+	rows, err := ReadToStruct[optionalRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows", len(rows))
+	}
+	if rows[0].ID == nil || *rows[0].ID != 0 || rows[0].Label != nil {
+		t.Errorf("row 1 got %+v", rows[0])
+	}
+	if rows[1].ID != nil || rows[1].Label == nil || *rows[1].Label != "x" {
+		t.Errorf("row 2 got %+v", rows[1])
+	}
+
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(out, rows); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, out); got != readFile(t, name) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestHeaderMatchNormalized(t *testing.T) {
+	name := writeFile(t, " Name ,CITY\nAda,London\n")
+	if _, err := ReadToStruct[excelRow](name); err == nil {
+		t.Error("exact match accepted \" Name \"")
+	}
+	rows, err := ReadToStructWithOptions[excelRow](name, Options{HeaderMatch: HeaderMatchNormalized})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []excelRow{{"Ada", "London"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
+
+func TestReadToStructCollect(t *testing.T) {
+	name := writeFile(t, "id,amount\n1,2.5\nx,3\n4,y\n5,6\n")
+	rows, rowErrs, err := ReadToStructCollect[amountRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{1, 2.5}, {5, 6}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+	if len(rowErrs) != 2 {
+		t.Fatalf("got %d errors, want 2", len(rowErrs))
+	}
+	for i, want := range []RowError{{Row: 3, Column: "id"}, {Row: 4, Column: "amount"}} {
+		got := rowErrs[i]
+		if got.Row != want.Row || got.Column != want.Column || !strings.Contains(got.Err.Error(), "invalid syntax") {
+			t.Errorf("error %d got %v, want row %d column %s", i, got, want.Row, want.Column)
+		}
+	}
+}
+
+func TestReadToStructCollectStrictRowWidth(t *testing.T) {
+	name := writeFile(t, "id,note\n1,a\n2\n3,c\n")
+	rows, rowErrs, err := ReadToStructCollectWithOptions[continuationRow](name, Options{PadShortRows: true, StrictRowWidth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []continuationRow{{"1", "a"}, {"3", "c"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+	if len(rowErrs) != 1 || rowErrs[0].Row != 3 || rowErrs[0].Err.Error() != "1 fields, header has 2" {
+		t.Errorf("got errors %v, want row 3 to violate the width", rowErrs)
+	}
+
+	// ReadToStructPartial fails the same row
+	_, failed, errs, err := ReadToStructPartialWithOptions[continuationRow](name, Options{PadShortRows: true, StrictRowWidth: true})
+	if err != nil || len(failed) != 1 || errs[0].Error() != "row 3 has 1 fields, header has 2" {
+		t.Errorf("partial got %v and %v", errs, err)
+	}
+}
+
+type positionalRow struct {
+	Code   string  `col:"1"`
+	Amount float64 `col:"amount"`
+	Last   string  `col:"3"`
+}
+
+func TestPositionalColumns(t *testing.T) {
+	rows, err := ReadToStruct[positionalRow](writeFile(t, "x,amount,?\nA1,2.5,z\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []positionalRow{{"A1", 2.5, "z"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	// a header named "1" wins over the position
+	rows, err = ReadToStruct[positionalRow](writeFile(t, "amount,?,1\n2.5,z,A1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []positionalRow{{"A1", 2.5, "A1"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	_, err = ReadToStruct[positionalRow](writeFile(t, "x,amount\nA1,2.5\n"))
+	if err == nil || !strings.Contains(err.Error(), "column 3 out of range, header has 2 columns") {
+		t.Errorf("got %v", err)
+	}
+}
+
+type verifiedRow struct {
+	ID       int   `col:"id"`
+	Verified *bool `col:"verified" true:"1" false:"0"`
+}
+
+func TestNullableBool(t *testing.T) {
+	name := writeFile(t, "id,verified\n1,1\n2,0\n3,\n")
+	rows, err := ReadToStruct[verifiedRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("got %d rows", len(rows))
+	}
+	if v := rows[0].Verified; v == nil || !*v {
+		t.Errorf("1 got %v", v)
+	}
+	if v := rows[1].Verified; v == nil || *v {
+		t.Errorf("0 got %v", v)
+	}
+	if v := rows[2].Verified; v != nil {
+		t.Errorf("empty got %v", *v)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(out, rows); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, out); got != readFile(t, name) {
+		t.Errorf("got %q", got)
+	}
+
+	if _, err := ReadToStruct[verifiedRow](writeFile(t, "id,verified\n1,yes\n")); err == nil {
+		t.Error("yes accepted with true:\"1\"")
+	}
+}
+
+func TestWriteWorkers(t *testing.T) {
+	in := make([]amountRow, 10000)
+	for i := range in {
+		in[i] = amountRow{i, float64(i) / 4}
+	}
+	dir := t.TempDir()
+	want := filepath.Join(dir, "want.csv")
+	if err := WriteFromStruct(want, in); err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{1, 3, 8} {
+		out := filepath.Join(dir, "out.csv")
+		if err := WriteFromStructWithOptions(out, in, Options{WriteWorkers: workers}); err != nil {
+			t.Fatal(err)
+		}
+		if readFile(t, out) != readFile(t, want) {
+			t.Errorf("%d workers changed the output", workers)
+		}
+	}
+
+	err := EncodeToWriterWithOptions(io.Discard, []chanRow{{}}, Options{WriteWorkers: 4})
+	if err == nil {
+		t.Error("unsupported field written with workers")
+	}
+}
+
+func BenchmarkWriteWorkers(b *testing.B) {
+	in := make([]amountRow, 100000)
+	for i := range in {
+		in[i] = amountRow{i, float64(i) / 3}
+	}
+	for _, workers := range []int{0, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for range b.N {
+				if err := EncodeToWriterWithOptions(io.Discard, in, Options{WriteWorkers: workers}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type Audit struct {
+	CreatedBy string `col:"created_by"`
+	CreatedAt string `col:"created_at"`
+}
+
+type auditedRow struct {
+	ID int `col:"id"`
+	Audit
+	// hides Audit.CreatedAt
+	CreatedAt string `col:"created"`
+}
+
+func TestEmbeddedStruct(t *testing.T) {
+	name := writeFile(t, "id,created_by,created\n1,ada,today\n")
+	rows, err := ReadToStruct[auditedRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []auditedRow{{ID: 1, Audit: Audit{CreatedBy: "ada"}, CreatedAt: "today"}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %+v, want %+v", rows, want)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(out, rows); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, out); got != readFile(t, name) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestAppendFromStruct(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := AppendFromStruct(name, []amountRow{{1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendFromStruct(name, []amountRow{{3, 4.5}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "id,amount\n1,2\n3,4.5\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// an empty existing file still gets the header
+	empty := writeFile(t, "")
+	if err := AppendFromStruct(empty, []amountRow{{1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, empty), "id,amount\n1,2\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStripLeadingZeros(t *testing.T) {
+	name := writeFile(t, "id,amount\n00042,  007.50\n0,000\n")
+	rows, err := ReadToStructWithOptions[amountRow](name, Options{StripLeadingZeros: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{42, 7.5}, {0, 0}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	name := writeFile(t, "id,amount\n1,2\nx,3\n4,5\ny,6\n7,8\n")
+	var seen []int
+	rows, err := ReadToStructWithOptions[amountRow](name, Options{OnError: func(row int, err error) bool {
+		seen = append(seen, row)
+		return true
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{1, 2}, {4, 5}, {7, 8}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+	if !reflect.DeepEqual(seen, []int{3, 5}) {
+		t.Errorf("called for rows %v, want [3 5]", seen)
+	}
+
+	seen = nil
+	_, err = ReadToStructWithOptions[amountRow](name, Options{OnError: func(row int, err error) bool {
+		seen = append(seen, row)
+		return false
+	}})
+	if err == nil || !strings.Contains(err.Error(), `cell "x"`) {
+		t.Errorf("got %v", err)
+	}
+	if !reflect.DeepEqual(seen, []int{3}) {
+		t.Errorf("called for rows %v after aborting", seen)
+	}
+}
+
+type interspersedRow struct {
+	internal int
+	ID       int `col:"id"`
+	Notes    string
+	Name     string `col:"name"`
+	Cache    []byte
+	Score    float64 `col:"score"`
+}
+
+func TestWriteInterspersedUntagged(t *testing.T) {
+	in := []interspersedRow{{internal: 9, ID: 1, Notes: "skip", Name: "Ada", Cache: []byte("x"), Score: 2.5}}
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(out, in); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "id,name,score\n1,Ada,2.5\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type matrixRow struct {
+	ID     int        `col:"id"`
+	Matrix [][]string `col:"matrix" nested:"true"`
+}
+
+func TestNestedField(t *testing.T) {
+	in := []matrixRow{{1, [][]string{{"a", "b,c"}, {`say "hi"`, ""}}}}
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(out, in); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := ReadToStruct[matrixRow](out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rows, in) {
+		t.Errorf("got %q, want %q", rows, in)
+	}
+
+	if _, err := ReadToStruct[matrixRow](writeFile(t, "id,matrix\n1,\"a,\"\"b\"\n")); err == nil {
+		t.Error("bad nested CSV accepted")
+	}
+}
+
+func TestStrict(t *testing.T) {
+	name := writeFile(t, "id,extra,other\n1,x,y\n")
+	if _, err := ReadToStruct[amountRow](name); err == nil || strings.Contains(err.Error(), "extra") {
+		t.Errorf("non strict got %v", err)
+	}
+
+	_, err := ReadToStructWithOptions[amountRow](name, Options{Strict: true})
+	if err == nil {
+		t.Fatal("strict read accepted the header")
+	}
+	for _, want := range []string{
+		"column amount does not exist",
+		"column extra is not mapped to a field",
+		"column other is not mapped to a field",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%v is missing %q", err, want)
+		}
+	}
+
+	if _, err := ReadToStructWithOptions[amountRow](writeFile(t, "amount,id\n1,2\n"), Options{Strict: true}); err != nil {
+		t.Errorf("exact header got %v", err)
+	}
+}
+
+func TestLoadHeaderMapping(t *testing.T) {
+	type customer struct {
+		ID   int
+		Name string
+	}
+	mapping, err := LoadHeaderMapping(writeFile(t, "source_header,struct_field\nCustomer Name,Name\nCust. No,ID\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := ReadToStructWithMapping[customer](writeFile(t, "Cust. No,Customer Name\n7,Ada\n"), mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []customer{{7, "Ada"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	for _, content := range []string{
+		"source_header,struct_field\nName,\n",
+		"source_header,struct_field\nName,Name\nName,ID\n",
+	} {
+		if _, err := LoadHeaderMapping(writeFile(t, content)); err == nil {
+			t.Errorf("%q accepted", content)
+		}
+	}
+}
+
+// cancelCell cancels cancelRead when the row numbered cancelAt is converted
+type cancelCell int
+
+var (
+	cancelRead func()
+	cancelAt   int
+	converted  int
+)
+
+func (c *cancelCell) UnmarshalCSV(cell string) error {
+	converted++
+	if converted == cancelAt {
+		cancelRead()
+	}
+	n, err := strconv.Atoi(cell)
+	*c = cancelCell(n)
+	return err
+}
+
+func TestReadToStructContext(t *testing.T) {
+	type row struct {
+		N cancelCell `col:"n"`
+	}
+	var b strings.Builder
+	b.WriteString("n\n")
+	for i := range 1000 {
+		fmt.Fprintln(&b, i)
+	}
+	name := writeFile(t, b.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelRead, cancelAt, converted = cancel, 10, 0
+	rows, err := ReadToStructContext[row](ctx, name)
+	if !errors.Is(err, context.Canceled) || rows != nil {
+		t.Errorf("got %d rows and %v, want context.Canceled", len(rows), err)
+	}
+	if converted != cancelAt {
+		t.Errorf("converted %d rows after cancelling at %d", converted, cancelAt)
+	}
+
+	cancelAt, converted = -1, 0
+	rows, err = ReadToStructContext[row](context.Background(), name)
+	if err != nil || len(rows) != 1000 {
+		t.Errorf("got %d rows and %v", len(rows), err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := ReadToStructContext[row](ctx, name); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled before reading got %v", err)
+	}
+}
+
+func TestValidateUTF8(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.csv")
+	opts := Options{ValidateUTF8: true}
+	if err := WriteFromStructWithOptions(out, []excelRow{{"Ada", "Zürich"}}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	err := WriteFromStructWithOptions(out, []excelRow{{"Ada", "London"}, {"Grace", "Z\xfcrich"}}, opts)
+	if err == nil || !strings.Contains(err.Error(), `row 3 column city: invalid UTF-8 "Z\xfcrich"`) {
+		t.Errorf("got %v", err)
+	}
+
+	opts.BOM = true
+	if err := WriteFromStructWithOptions(out, []excelRow{{"Ada", "London"}}, opts); err == nil {
+		t.Error("BOM written with ValidateUTF8")
+	}
+}
+
+func TestAutoMatchSnakeCase(t *testing.T) {
+	type row struct {
+		FirstName string
+		HTTPPort  int
+		Nickname  string
+		City      string `col:"town"`
+	}
+	name := writeFile(t, "FIRST_NAME,http_port,town\nAda,8080,London\n")
+	rows, err := ReadToStructWithOptions[row](name, Options{AutoMatchSnakeCase: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []row{{"Ada", 8080, "", "London"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	rows, err = ReadToStruct[row](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].FirstName != "" {
+		t.Errorf("untagged field read without the option: %v", rows)
+	}
+}
+
+func TestInternStrings(t *testing.T) {
+	name := writeFile(t, "name,city\nAda,London\nGrace,London\n")
+	rows, err := ReadToStructWithOptions[excelRow](name, Options{InternStrings: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsafe.StringData(rows[0].City) != unsafe.StringData(rows[1].City) {
+		t.Error("London is not shared")
+	}
+
+	rows, err = ReadToStruct[excelRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsafe.StringData(rows[0].City) == unsafe.StringData(rows[1].City) {
+		t.Error("London is shared without InternStrings")
+	}
+}
+
+type cityRow struct {
+	ID   int    `col:"id"`
+	City string `col:"city"`
+}
+
+type internedCityRow struct {
+	ID   int    `col:"id"`
+	City string `col:"city" intern:"true"`
+}
+
+func TestInternTag(t *testing.T) {
+	name := writeFile(t, "id,city\n1,London\n2,London\n")
+	rows, err := ReadToStruct[internedCityRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsafe.StringData(rows[0].City) != unsafe.StringData(rows[1].City) {
+		t.Error("London is not shared")
+	}
+
+	type mixed struct {
+		Name string `col:"name"`
+		City string `col:"city" intern:"true"`
+	}
+	both, err := ReadToStruct[mixed](writeFile(t, "name,city\nAda,London\nAda,London\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsafe.StringData(both[0].Name) == unsafe.StringData(both[1].Name) {
+		t.Error("untagged name column is interned")
+	}
+}
+
+// BenchmarkInternStrings reports the heap still held by the rows read, after
+// a GC, alongside the cost of reading them
+func BenchmarkInternStrings(b *testing.B) {
+	var content strings.Builder
+	content.WriteString("id,city\n")
+	for i := range 100000 {
+		fmt.Fprintf(&content, "%d,city%d\n", i, i%10)
+	}
+	data := content.String()
+	b.Run("none", func(b *testing.B) {
+		benchmarkRetained[cityRow](b, data, Options{})
+	})
+	b.Run("tag", func(b *testing.B) {
+		benchmarkRetained[internedCityRow](b, data, Options{})
+	})
+	b.Run("InternStrings", func(b *testing.B) {
+		benchmarkRetained[cityRow](b, data, Options{InternStrings: true})
+	})
+}
+
+func benchmarkRetained[T any](b *testing.B, data string, opts Options) {
+	b.ReportAllocs()
+	var retained int64
+	for range b.N {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		rows, err := DecodeFromReaderWithOptions[T](strings.NewReader(data), opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		retained += int64(after.HeapAlloc) - int64(before.HeapAlloc)
+		runtime.KeepAlive(rows)
+	}
+	b.ReportMetric(float64(retained)/float64(b.N), "retained-B/op")
+}
+
+func TestEmptySentinelRow(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStructWithOptions(out, []amountRow{}, Options{EmptySentinelRow: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "id,amount\n,\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	type single struct {
+		Name string `col:"name"`
+	}
+	opts := Options{EmptySentinelRow: true, UseCRLF: true}
+	if err := WriteFromStructWithOptions(out, []single{}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "name\r\n\"\"\r\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	rows, err := ReadToStruct[single](out)
+	if err != nil || len(rows) != 1 {
+		t.Errorf("read back %v, %v, want one empty row", rows, err)
+	}
+
+	// any one column row of an empty cell is kept the same way
+	if err := WriteFromStruct(out, []single{{"a"}, {""}, {"b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "name\na\n\"\"\nb\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type tailRow struct {
+	ID     string   `col:"id"`
+	Values []string `col:"...values"`
+}
+
+func TestRestField(t *testing.T) {
+	name := writeFile(t, "id,values\na,1,2,3\nb,4\nc\n")
+	rows, err := ReadToStruct[tailRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tailRow{{"a", []string{"1", "2", "3"}}, {"b", []string{"4"}}, {"c", nil}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %q, want %q", rows, want)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(out, rows[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "id,values\na,1,2,3\nb,4\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	type badRest struct {
+		Values string `col:"...values"`
+	}
+	if _, err := ReadToStruct[badRest](name); err == nil || !strings.Contains(err.Error(), "must be a []string") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestRestFieldWriteType(t *testing.T) {
+	type Tail []string
+	type namedRest struct {
+		ID     string `col:"id"`
+		Values Tail   `col:"...values"`
+	}
+	type intRest struct {
+		ID     string `col:"id"`
+		Values []int  `col:"...values"`
+	}
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(out, []namedRest{{"a", Tail{"1"}}}); err == nil || err.Error() != "field Values with a ... tag must be a []string" {
+		t.Errorf("named slice got %v", err)
+	}
+	if err := WriteFromStruct(out, []intRest{{"a", []int{1}}}); err == nil || err.Error() != "field Values with a ... tag must be a []string" {
+		t.Errorf("int slice got %v", err)
+	}
+}
+
+type centsRow struct {
+	Price float64 `col:"price" scale:"100" round:"2"`
+	Rate  float64 `col:"rate" scale:"3" round:"4"`
+}
+
+func TestRoundTag(t *testing.T) {
+	rows, err := ReadToStruct[centsRow](writeFile(t, "price,rate\n2537,1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].Price != 25.37 || rows[0].Rate != 0.3333 {
+		t.Errorf("got %v", rows[0])
+	}
+
+	type badRound struct {
+		Price float64 `col:"price" scale:"100" round:"x"`
+	}
+	if _, err := ReadToStruct[badRound](writeFile(t, "price\n1\n")); err == nil {
+		t.Error("round:\"x\" accepted")
+	}
+}
+
+type accountRow struct {
+	Account string `col:"account" preserve:"true"`
+	Plain   string `col:"plain"`
+}
+
+func TestPreserveTag(t *testing.T) {
+	opts := Options{TypeConsistencyCheck: true}
+	name := writeFile(t, "account,plain\n0123456789012345,1\nAC-1,2\n")
+	rows, err := ReadToStructWithOptions[accountRow](name, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].Account != "0123456789012345" {
+		t.Errorf("got %q", rows[0].Account)
+	}
+
+	_, err = ReadToStructWithOptions[accountRow](writeFile(t, "account,plain\n1,0123456789012345\n2,AC-1\n"), opts)
+	if err == nil || !strings.Contains(err.Error(), `column plain: "AC-1" is string, first row is int`) {
+		t.Errorf("untagged column got %v", err)
+	}
+}
+
+func TestSniffContent(t *testing.T) {
+	opts := Options{SniffContent: true}
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"\n  <!DOCTYPE html>\n<html><body>502 Bad Gateway</body></html>\n", "HTML"},
+		{"\ufeff{\"error\": \"not found\"}\n", "JSON"},
+	}
+	for _, tt := range tests {
+		_, err := ReadToStructWithOptions[excelRow](writeFile(t, tt.content), opts)
+		if !errors.Is(err, ErrNotCSV) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v", tt.content, err)
+		}
+	}
+
+	if _, err := ReadToStructWithOptions[excelRow](writeFile(t, "name,city\n<b>,{x}\n"), opts); err != nil {
+		t.Errorf("CSV rejected: %v", err)
+	}
+	if _, err := ReadToStruct[excelRow](writeFile(t, tests[0].content)); errors.Is(err, ErrNotCSV) {
+		t.Error("sniffed without SniffContent")
+	}
+}
+
+// countingWriter counts the writes reaching it
+type countingWriter struct {
+	strings.Builder
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Builder.Write(p)
+}
+
+func TestBufferSize(t *testing.T) {
+	in := make([]amountRow, 20000)
+	for i := range in {
+		in[i] = amountRow{i, 1.5}
+	}
+	var plain, buffered countingWriter
+	if err := EncodeToWriterWithOptions(&plain, in, Options{WriteChecksum: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeToWriterWithOptions(&buffered, in, Options{WriteChecksum: true, BufferSize: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	if buffered.String() != plain.String() {
+		t.Error("BufferSize changed the output")
+	}
+	if buffered.writes >= plain.writes {
+		t.Errorf("%d writes with BufferSize, %d without", buffered.writes, plain.writes)
+	}
+}
+
+func BenchmarkBufferSize(b *testing.B) {
+	in := make([]amountRow, 100000)
+	for i := range in {
+		in[i] = amountRow{i, float64(i) / 8}
+	}
+	name := filepath.Join(b.TempDir(), "out.csv")
+	for _, size := range []int{0, 1 << 20} {
+		b.Run(fmt.Sprintf("BufferSize=%d", size), func(b *testing.B) {
+			for range b.N {
+				if err := WriteFromStructWithOptions(name, in, Options{BufferSize: size}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderComma(t *testing.T) {
+	name := writeFile(t, "id\tamount\n1,2.5\n3,4\n")
+	rows, err := ReadToStructWithOptions[amountRow](name, Options{HeaderComma: '\t'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{1, 2.5}, {3, 4}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	rows, err = ReadToStructWithOptions[amountRow](writeFile(t, "id,amount\n1;2.5\n"), Options{Comma: ';', HeaderComma: ','})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{1, 2.5}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	if _, err := ReadToStructWithOptions[amountRow](name, Options{HeaderComma: '"'}); err == nil {
+		t.Error("quote accepted as HeaderComma")
+	}
+}
+
+func TestCellInError(t *testing.T) {
+	_, err := ReadToStruct[amountRow](writeFile(t, "id,amount\n1,2\n2,12.3.4\n"))
+	if err == nil || !strings.Contains(err.Error(), `row 3: field float Amount invalid: invalid syntax, cell "12.3.4"`) {
+		t.Errorf("got %v", err)
+	}
+
+	// a huge cell is cut at maxCellInError bytes without splitting a rune
+	huge := strings.Repeat("a", maxCellInError-1) + "é" + strings.Repeat("b", 100)
+	_, err = ReadToStruct[amountRow](writeFile(t, "id,amount\n1,"+huge+"\n"))
+	want := fmt.Sprintf(`cell %q...`, strings.Repeat("a", maxCellInError-1))
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("got %v, want it to end in %s", err, want)
+	}
+}
+
+type rawRow struct {
+	ID  int    `col:"id"`
+	Raw string `col:"@raw"`
+}
+
+func TestRawColumn(t *testing.T) {
+	rows, err := ReadToStruct[rawRow](writeFile(t, "id,note\n1,plain\n2,\"a, b\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []rawRow{{1, "1,plain"}, {2, `2,"a, b"`}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %q, want %q", rows, want)
+	}
+
+	rows, err = ReadToStructWithOptions[rawRow](writeFile(t, "id;note\n3;x\n"), Options{Comma: ';'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].Raw != "3;x" {
+		t.Errorf("got %q", rows[0].Raw)
+	}
+
+	type badRaw struct {
+		Raw int `col:"@raw"`
+	}
+	if _, err := ReadToStruct[badRaw](writeFile(t, "id\n1\n")); err == nil {
+		t.Error("@raw accepted on an int")
+	}
+}
+
+func TestTrailingBlank(t *testing.T) {
+	want := []excelRow{{"Ada", "London"}}
+	for _, content := range []string{
+		"name,city\nAda,London",
+		"name,city\nAda,London\n",
+		"name,city\nAda,London\n \n",
+		"name,city\r\nAda,London\r\n\t\r\n  ",
+	} {
+		rows, err := ReadToStruct[excelRow](writeFile(t, content))
+		if err != nil {
+			t.Errorf("%q: %v", content, err)
+			continue
+		}
+		if !reflect.DeepEqual(rows, want) {
+			t.Errorf("%q: got %q, want %q", content, rows, want)
+		}
+	}
+
+	// whitespace followed by more data is still a record
+	if _, err := ReadToStruct[excelRow](writeFile(t, "name,city\nAda,London\n \nGrace,NYC\n")); err == nil {
+		t.Error("\" \" row in the middle accepted")
+	}
+}
+
+func TestTrailingBlankSplitter(t *testing.T) {
+	split := func(line string) []string { return strings.Split(line, "|") }
+	rows, err := ReadToStructWithSplitter[splitRow](writeFile(t, "name|qty\nbolt|12\n \n"), split)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []splitRow{{"bolt", 12}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	type nameOnly struct {
+		Name string `col:"name"`
+	}
+	names, err := ReadToStructWithSplitter[nameOnly](writeFile(t, "name\nbolt\n \n"), split)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []nameOnly{{"bolt"}}; !reflect.DeepEqual(names, want) {
+		t.Errorf("one column got %q, want %q", names, want)
+	}
+}
+
+type fallbackRow struct {
+	ID     int     `col:"1|id"`
+	Amount float64 `col:"3|amount"`
+}
+
+func TestPositionFallback(t *testing.T) {
+	// column 3 is out of range so amount is found by name
+	rows, err := ReadToStruct[fallbackRow](writeFile(t, "id,amount\n1,2.5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []fallbackRow{{1, 2.5}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	rows, err = ReadToStruct[fallbackRow](writeFile(t, "a,b,c\n1,x,2.5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []fallbackRow{{1, 2.5}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("by position got %v, want %v", rows, want)
+	}
+
+	_, err = ReadToStruct[fallbackRow](writeFile(t, "id,value\n1,2.5\n"))
+	if err == nil || !strings.Contains(err.Error(), "no column matches 3|amount") {
+		t.Errorf("got %v", err)
+	}
+}
+
+type productRow struct {
+	Name  string  `col:"name"`
+	Price float64 `col:"price"`
+}
+
+func TestTemplateColumns(t *testing.T) {
+	label := template.Must(template.New("label").Parse(`{{.Name}} ({{printf "%.2f" .Price}})`))
+	opts := Options{TemplateColumns: []TemplateColumn{{Header: "label", Template: label}}}
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStructWithOptions(out, []productRow{{"tea", 2.5}}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "name,price,label\ntea,2.5,tea (2.50)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	missing := template.Must(template.New("bad").Option("missingkey=error").Parse(`{{.Missing}}`))
+	opts = Options{TemplateColumns: []TemplateColumn{{Header: "bad", Template: missing}}}
+	err := WriteFromStructWithOptions(out, []productRow{{Name: "tea"}}, opts)
+	if err == nil || !strings.Contains(err.Error(), "row 2 column bad:") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestStripCellBOM(t *testing.T) {
+	// two exports joined together, the second keeping its BOM
+	name := writeFile(t, "\ufeffid,amount\n1,2\n\ufeff3,4\n")
+	if _, err := ReadToStruct[amountRow](name); err == nil {
+		t.Error("cell starting with a BOM read as an int")
+	}
+	rows, err := ReadToStructWithOptions[amountRow](name, Options{StripCellBOM: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{1, 2}, {3, 4}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
+
+type localeRow struct {
+	PriceDE float64 `col:"price_de"`
+	PriceUS float64 `col:"price_us"`
+	Units   int     `col:"units"`
+}
+
+func TestNumberFormats(t *testing.T) {
+	opts := Options{NumberFormats: map[string]NumberFormat{
+		"price_de": {Group: '.', Decimal: ','},
+		"price_us": {Group: ','},
+		"units":    {Group: ' '},
+	}}
+	rows, err := ReadToStructWithOptions[localeRow](writeFile(t, "price_de,price_us,units\n\"1.234,56\",\"1,234.56\",1 000\n"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []localeRow{{1234.56, 1234.56, 1000}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	if _, err := ReadToStruct[localeRow](writeFile(t, "price_de,price_us,units\n\"1,5\",1,1\n")); err == nil {
+		t.Error("1,5 read without a NumberFormat")
+	}
+}
+
+func TestAggregates(t *testing.T) {
+	in := []amountRow{{1, 2.5}, {2, 4}, {3, 0}}
+	opts := Options{
+		Aggregates:     map[string]Aggregate{"amount": AggregateSum},
+		AggregateLabel: "Total",
+	}
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStructWithOptions(out, in, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "id,amount\n1,2.5\n2,4\n3,0\nTotal,6.5\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	opts.Aggregates = map[string]Aggregate{"id": AggregateCount, "amount": AggregateAvg}
+	if err := WriteFromStructWithOptions(out, in, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "id,amount\n1,2.5\n2,4\n3,0\n3,2.1666666666666665\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	opts.Aggregates = map[string]Aggregate{"total": AggregateSum}
+	if err := WriteFromStructWithOptions(out, in, opts); err == nil || !strings.Contains(err.Error(), "aggregate column total does not exist") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestAggregatesFormattedFields(t *testing.T) {
+	type row struct {
+		Name       string        `col:"name"`
+		Population int           `col:"population" group:","`
+		Latency    int           `col:"latency" suffix:"ms"`
+		Reading    float64       `col:"reading" scale:"100"`
+		Wait       time.Duration `col:"wait"`
+		Score      *float64      `col:"score"`
+	}
+	score := 4.5
+	in := []row{
+		{"a", 1234, 5, 0.125, time.Second, &score},
+		{"b", 2000, 7, 0.125, 2 * time.Second, nil},
+	}
+	out := filepath.Join(t.TempDir(), "out.csv")
+	err := WriteFromStructWithOptions(out, in, Options{
+		Aggregates: map[string]Aggregate{
+			"population": AggregateSum,
+			"latency":    AggregateAvg,
+			"reading":    AggregateSum,
+			"wait":       AggregateAvg,
+			"score":      AggregateCount,
+		},
+		AggregateLabel: "Total",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "name,population,latency,reading,wait,score\n" +
+		"a,\"1,234\",5ms,13,1s,4.5\n" +
+		"b,\"2,000\",7ms,13,2s,\n" +
+		"Total,\"3,234\",6ms,25,1.5s,1\n"
+	if got := readFile(t, out); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestAggregatesRestField(t *testing.T) {
+	in := []tailRow{{"a", []string{"1", "2"}}, {"b", nil}}
+	computed := []ComputedColumn{{Header: "n", Value: func(rec any) string {
+		return strconv.Itoa(len(rec.(tailRow).Values))
+	}}}
+	out := filepath.Join(t.TempDir(), "out.csv")
+	for col, want := range map[string]string{
+		"values": "aggregate column values is a rest field",
+		"n":      "aggregate column n follows the rest field values",
+	} {
+		err := WriteFromStructWithOptions(out, in, Options{
+			ComputedColumns: computed,
+			Aggregates:      map[string]Aggregate{col: AggregateSum},
+		})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", col, err, want)
+		}
+	}
+
+	// columns before the rest field are still summed, whatever the row widths
+	err := WriteFromStructWithOptions(out, in, Options{Aggregates: map[string]Aggregate{"id": AggregateCount}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "id,values\na,1,2\nb\n2,\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTSVQuotedTabs(t *testing.T) {
+	opts := Options{Comma: '\t'}
+	name := writeFile(t, "name\tcity\n\"Ada\tLovelace\"\tLondon\n")
+	rows, err := ReadToStructWithOptions[excelRow](name, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []excelRow{{"Ada\tLovelace", "London"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %q, want %q", rows, want)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.tsv")
+	if err := WriteFromStructWithOptions(out, rows, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, out); got != readFile(t, name) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCellTransform(t *testing.T) {
+	var seen []string
+	opts := Options{
+		ComputedColumns: []ComputedColumn{{Header: "n", Value: func(rec any) string {
+			return strconv.Itoa(len(rec.(tailRow).Values))
+		}}},
+		CellTransform: func(column, value string) string {
+			seen = append(seen, column+"="+value)
+			if column == "values" {
+				return "*"
+			}
+			return value
+		},
+	}
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStructWithOptions(out, []tailRow{{"a", []string{"1", "2", "3"}}, {"b", nil}}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, out), "id,values,n\na,*,*,*,3\nb,0\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	want := []string{"id=a", "values=1", "values=2", "values=3", "n=3", "id=b", "n=0"}
+	if !reflect.DeepEqual(seen, want) {
+		t.Errorf("called with %q, want %q", seen, want)
+	}
+}
+
+func TestTimeRange(t *testing.T) {
+	name := writeFile(t, "name,at\na,2024-02-28\nb,2024-03-01\nc,2024-03-07\nd,2024-03-08\ne,2024-03-04\n")
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	opts := Options{TimeRangeField: "At", TimeFrom: day(1), TimeTo: day(7)}
+	rows, err := ReadToStructWithOptions[eventRow](name, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []eventRow{{"b", day(1)}, {"c", day(7)}, {"e", day(4)}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	// MaxRows counts the rows kept, not the rows skipped before them
+	opts.MaxRows = 2
+	rows, err = ReadToStructWithOptions[eventRow](name, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []eventRow{{"b", day(1)}, {"c", day(7)}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("with MaxRows got %v, want %v", rows, want)
+	}
+
+	opts = Options{TimeRangeField: "Name"}
+	if _, err := ReadToStructWithOptions[eventRow](name, opts); err == nil || !strings.Contains(err.Error(), "is not a time.Time field") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestTimeRangePartialAndCollect(t *testing.T) {
+	name := writeFile(t, "name,at\na,2024-02-28\nb,2024-03-01\nc,bad\nd,2024-03-08\n")
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	opts := Options{TimeRangeField: "At", TimeFrom: day(1), TimeTo: day(7)}
+	want := []eventRow{{"b", day(1)}}
+
+	rows, failed, errs, err := ReadToStructPartialWithOptions[eventRow](name, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("partial got %v, want %v", rows, want)
+	}
+	if len(failed) != 1 || len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "row 4: ") {
+		t.Errorf("partial failed %v with %v", failed, errs)
+	}
+
+	rows, rowErrs, err := ReadToStructCollectWithOptions[eventRow](name, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("collect got %v, want %v", rows, want)
+	}
+	if len(rowErrs) != 1 || rowErrs[0].Row != 4 {
+		t.Errorf("collect errors %v", rowErrs)
+	}
+
+	if _, _, err := ReadToStructCollectWithOptions[eventRow](name, Options{TimeRangeField: "Name"}); err == nil || !strings.Contains(err.Error(), "is not a time.Time field") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	var preview strings.Builder
+	out := filepath.Join(t.TempDir(), "out.csv")
+	in := []amountRow{{1, 2.5}, {22, 4}, {333, 5}}
+	if err := WriteFromStructWithOptions(out, in, Options{PreviewTo: &preview, PreviewRows: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := preview.String(), "# id  amount\n# 1   2.5\n# 22  4\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := readFile(t, out), "id,amount\n1,2.5\n22,4\n333,5\n"; got != want {
+		t.Errorf("file got %q, want %q", got, want)
+	}
+}
+
+func TestQuotedNumbersInferredAsStrings(t *testing.T) {
+	opts := Options{TypeConsistencyCheck: true}
+	// id is quoted throughout so "AC-1" is accepted after "00042"
+	name := writeFile(t, "id,count,price\n\"00042\",1,2\n\"AC-1\",2,3\n")
+	rows, err := ReadToStructWithOptions[inferredRow](name, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].ID != "00042" {
+		t.Errorf("got %q", rows[0].ID)
+	}
+
+	opts.CoerceQuotedNumbers = true
+	_, err = ReadToStructWithOptions[inferredRow](name, opts)
+	if err == nil || !strings.Contains(err.Error(), `column id: "AC-1" is string, first row is int`) {
+		t.Errorf("coerced got %v", err)
+	}
+
+	// one unquoted cell makes the column inferred from its values again
+	_, err = ReadToStructWithOptions[inferredRow](writeFile(t, "id,count,price\n00042,1,2\n\"AC-1\",2,3\n"), Options{TypeConsistencyCheck: true})
+	if err == nil {
+		t.Error("partly quoted column treated as strings")
+	}
+}
+
+func TestMaxLineBytes(t *testing.T) {
+	opts := Options{MaxLineBytes: 10}
+	if _, err := ReadToStructWithOptions[amountRow](writeFile(t, "id,amount\n1,2\n"), opts); err != nil {
+		t.Errorf("short lines rejected: %v", err)
+	}
+
+	_, err := ReadToStructWithOptions[amountRow](writeFile(t, "id,amount\n1,2\n3,"+strings.Repeat("4", 1<<20)+"\n"), opts)
+	if !errors.Is(err, ErrLineTooLong) || !strings.Contains(err.Error(), "line 3 is over 10 bytes") {
+		t.Errorf("got %v", err)
+	}
+}
+
+type hashedRow struct {
+	Key  string `col:"@hash:name,dob"`
+	Name string `col:"name"`
+}
+
+func TestHashColumn(t *testing.T) {
+	rows, err := ReadToStruct[hashedRow](writeFile(t, "name,dob,city\nAda,1815,London\nAda,1815,Paris\nab,c,x\na,bc,x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].Key != rows[1].Key {
+		t.Errorf("same cells gave %s and %s", rows[0].Key, rows[1].Key)
+	}
+	if rows[2].Key == rows[3].Key {
+		t.Error(`"ab","c" and "a","bc" hash the same`)
+	}
+	if len(rows[0].Key) != 16 || rows[0].Key == rows[2].Key {
+		t.Errorf("got %q and %q", rows[0].Key, rows[2].Key)
+	}
+
+	// the hash only depends on the cells, not their position in the file
+	again, err := ReadToStruct[hashedRow](writeFile(t, "dob,name\n1815,Ada\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again[0].Key != rows[0].Key {
+		t.Errorf("reordered columns gave %s, want %s", again[0].Key, rows[0].Key)
+	}
+
+	if _, err := ReadToStruct[hashedRow](writeFile(t, "name\nAda\n")); err == nil {
+		t.Error("hash of a missing column accepted")
+	}
+}
+
+type formulaRow struct {
+	Note    string  `col:"note"`
+	Change  int     `col:"change" group:","`
+	Latency int     `col:"latency" suffix:"ms"`
+	Delta   float64 `col:"delta"`
+}
+
+func TestSanitizeFormulas(t *testing.T) {
+	in := []formulaRow{
+		{"=SUM(A1)", -1234, -5, -0.5},
+		{"-5", 1, 2, 3},
+		{"@cmd", 0, 0, 0},
+		{"-not a number", 0, 0, 0},
+	}
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStructWithOptions(out, in, Options{SanitizeFormulas: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := "note,change,latency,delta\n" +
+		"'=SUM(A1),\"-1,234\",-5ms,-0.5\n" +
+		"-5,1,2ms,3\n" +
+		"'@cmd,0,0ms,0\n" +
+		"'-not a number,0,0ms,0\n"
+	if got := readFile(t, out); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := WriteFromStructWithOptions(out, in[:1], Options{SanitizeFormulas: true, FormulaEscape: "\t"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, out); !strings.Contains(got, "\t=SUM(A1)") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestStrictNumbers(t *testing.T) {
+	opts := Options{StrictNumbers: true}
+	for _, cell := range []string{"12 (approx)", "0x1F", "Inf", "1_000"} {
+		_, err := ReadToStructWithOptions[amountRow](writeFile(t, "id,amount\n1,"+cell+"\n"), opts)
+		if err == nil {
+			t.Errorf("%q accepted", cell)
+		}
+	}
+	_, err := ReadToStructWithOptions[amountRow](writeFile(t, "id,amount\n1,12 (approx)\n"), opts)
+	if err == nil || !strings.Contains(err.Error(), `" (approx)"`) {
+		t.Errorf("junk not named in %v", err)
+	}
+
+	rows, err := ReadToStructWithOptions[amountRow](writeFile(t, "id,amount\n-1,+2.5e3\n"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{-1, 2500}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
+
+type statusRow struct {
+	Status string `col:"status" enum:"active,closed,other" unknown:"other"`
+	Paid   bool   `col:"paid" true:"yes" false:"no" unknown:"no"`
+}
+
+func TestUnknownTag(t *testing.T) {
+	rows, err := ReadToStruct[statusRow](writeFile(t, "status,paid\nactive,yes\npending,maybe\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []statusRow{{"active", true}, {"other", false}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	type strictStatus struct {
+		Status string `col:"status" enum:"active,closed"`
+	}
+	if _, err := ReadToStruct[strictStatus](writeFile(t, "status\npending\n")); err == nil {
+		t.Error("pending accepted without an unknown tag")
+	}
+}
+
+func TestNilElements(t *testing.T) {
+	in := []*amountRow{{1, 2}, nil, {3, 4}}
+	out := filepath.Join(t.TempDir(), "out.csv")
+	err := WriteFromStruct(out, in)
+	if err == nil || !strings.Contains(err.Error(), "row 3: element 1 is nil") {
+		t.Errorf("got %v", err)
+	}
+
+	tests := []struct {
+		mode NilElementMode
+		want string
+	}{
+		{NilElementSkip, "id,amount\n1,2\n3,4\n"},
+		{NilElementEmpty, "id,amount\n1,2\n,\n3,4\n"},
+	}
+	for _, tt := range tests {
+		if err := WriteFromStructWithOptions(out, in, Options{NilElements: tt.mode}); err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, out); got != tt.want {
+			t.Errorf("mode %d got %q, want %q", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestComputedColumnsFromPointers(t *testing.T) {
+	label := template.Must(template.New("label").Parse(`{{.Name}}!`))
+	opts := Options{
+		ComputedColumns: []ComputedColumn{{Header: "double", Value: func(rec any) string {
+			return strconv.FormatFloat(rec.(productRow).Price*2, 'f', -1, 64)
+		}}},
+		TemplateColumns: []TemplateColumn{{Header: "label", Template: label}},
+		NilElements:     NilElementSkip,
+	}
+	var b strings.Builder
+	if err := EncodeToWriterWithOptions(&b, []*productRow{{"tea", 2.5}, nil}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "name,price,double,label\ntea,2.5,5,tea!\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestValueRemap(t *testing.T) {
+	type countryRow struct {
+		Country string `col:"country"`
+		Code    Color  `col:"color" enum:"Red,Green,Blue"`
+	}
+	opts := Options{ValueRemap: map[string]map[string]string{
+		"country": {"USA": "US", "U.S.A.": "US"},
+		"color":   {"crimson": "Red"},
+	}}
+	rows, err := ReadToStructWithOptions[countryRow](writeFile(t, "country,color\nUSA,crimson\nU.S.A.,Green\nFR,Blue\n"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []countryRow{{"US", Red}, {"US", Green}, {"FR", Blue}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
+
+func TestHeaderTransform(t *testing.T) {
+	opts := Options{
+		HeaderTransform: func(h string) string { return "x_" + h },
+		Aggregates:      map[string]Aggregate{"amount": AggregateSum},
+		CellTransform: func(column, value string) string {
+			if column == "id" {
+				return "#" + value
+			}
+			return value
+		},
+	}
+	var b strings.Builder
+	if err := EncodeToWriterWithOptions(&b, []amountRow{{1, 2}, {2, 3}}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "x_id,x_amount\n#1,2\n#2,3\n,5\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
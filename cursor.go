@@ -0,0 +1,152 @@
+package csvutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Cursor reads a CSV file one row at a time, like sql.Rows
+// eg.
+//
+//	c, err := OpenCursor[Test]("data.csv")
+//	if err != nil {
+//	    return err
+//	}
+//	defer c.Close()
+//	for c.Next() {
+//	    var t Test
+//	    if err := c.Scan(&t); err != nil {
+//	        return err
+//	    }
+//	}
+//	return c.Err()
+type Cursor[T any] struct {
+	f    *os.File
+	r    *recordReader
+	conv func(row []string) (*T, error)
+	row  []string
+	n    int
+	err  error
+}
+
+// Open filename and read its header, the file stays open until Close is
+// called or Next reaches the end of the file.
+func OpenCursor[T any](filename string) (*Cursor[T], error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file %s", err)
+	}
+
+	r, err := newRecordReader(&trailingBlankReader{r: decodeBOM(f)}, Options{}, newReadState[T]())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if r.header == nil {
+		f.Close()
+		return nil, ErrNoHeader
+	}
+
+	conv, err := readColumnDefCreateStruct[T](r.header, Options{})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Cursor[T]{f: f, r: r, conv: conv, n: 1}, nil
+}
+
+// Next reads the next row for Scan. It returns false and closes the file at the
+// end of the input or on a read error, which is then returned by Err.
+func (c *Cursor[T]) Next() bool {
+	c.row = nil
+	if c.f == nil {
+		return false
+	}
+
+	row, err := c.r.next()
+	if err != nil {
+		if err != io.EOF {
+			c.err = fmt.Errorf("unable to parse file as CSV %s", err)
+		}
+		if err := c.Close(); err != nil && c.err == nil {
+			c.err = err
+		}
+		return false
+	}
+	c.row = row
+	c.n++
+	return true
+}
+
+// Scan converts the current row into dest
+func (c *Cursor[T]) Scan(dest *T) error {
+	if c.row == nil {
+		return errors.New("Scan called without a successful Next")
+	}
+	elem, err := c.conv(c.row)
+	if err != nil {
+		return fmt.Errorf("row %d: %w", c.n, err)
+	}
+	*dest = *elem
+	return nil
+}
+
+// Err returns the error that stopped Next, if any
+func (c *Cursor[T]) Err() error {
+	return c.err
+}
+
+// Close closes the underlying file, it is safe to call more than once
+func (c *Cursor[T]) Close() error {
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+// Read filename batchSize rows at a time and call fn with each batch, the last
+// one may be shorter. The slice passed to fn is reused for the next batch so fn
+// must copy anything it keeps. Reading stops at the first error from fn, which
+// is returned as is. A row that fails to read also stops it, the rows before it
+// are passed to fn first.
+func ReadInBatches[T any](filename string, batchSize int, fn func([]T) error) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("batch size %d must be positive", batchSize)
+	}
+	c, err := OpenCursor[T](filename)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	batch := make([]T, 0, batchSize)
+	// flush hands fn the rows read before err stopped the read
+	flush := func(err error) error {
+		if len(batch) > 0 {
+			if fnErr := fn(batch); fnErr != nil {
+				return fnErr
+			}
+		}
+		return err
+	}
+	for c.Next() {
+		var t T
+		if err := c.Scan(&t); err != nil {
+			return flush(err)
+		}
+		batch = append(batch, t)
+		if len(batch) == batchSize {
+			if err := fn(batch); err != nil {
+				return err
+			}
+			clear(batch)
+			batch = batch[:0]
+		}
+	}
+	return flush(c.Err())
+}
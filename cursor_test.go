@@ -0,0 +1,176 @@
+package csvutil
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCursor(t *testing.T) {
+	c, err := OpenCursor[amountRow](writeFile(t, "id,amount\n1,9.99\n2,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	got := []amountRow{}
+	for c.Next() {
+		var r amountRow
+		if err := c.Scan(&r); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{1, 9.99}, {2, 5}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if c.f != nil {
+		t.Error("file still open at the end of the input")
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestCursorScanError(t *testing.T) {
+	c, err := OpenCursor[amountRow](writeFile(t, "id,amount\n1,oops\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var r amountRow
+	if err := c.Scan(&r); err == nil {
+		t.Error("Scan before Next succeeded")
+	}
+	if !c.Next() {
+		t.Fatal(c.Err())
+	}
+	if err := c.Scan(&r); err == nil || err.Error() != `row 2: field float Amount invalid: invalid syntax, cell "oops"` {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCursorRestField(t *testing.T) {
+	name := writeFile(t, "id,values\na,1,2,3\nb,4\nc\n")
+	want := []tailRow{{"a", []string{"1", "2", "3"}}, {"b", []string{"4"}}, {"c", nil}}
+
+	c, err := OpenCursor[tailRow](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got := []tailRow{}
+	for c.Next() {
+		var r tailRow
+		if err := c.Scan(&r); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("cursor got %q, want %q", got, want)
+	}
+
+	got = got[:0]
+	err = ReadInBatches(name, 2, func(batch []tailRow) error {
+		got = append(got, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("batches got %q, want %q", got, want)
+	}
+}
+
+func TestCursorTrailingBlank(t *testing.T) {
+	c, err := OpenCursor[excelRow](writeFile(t, "name,city\nAda,London\n \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	n := 0
+	for c.Next() {
+		n++
+	}
+	if err := c.Err(); err != nil || n != 1 {
+		t.Errorf("got %d rows and %v, want 1 row", n, err)
+	}
+}
+
+func TestReadInBatchesFlushesOnError(t *testing.T) {
+	name := writeFile(t, "id,amount\n1,2\n2,3\n3,4\nx,5\n6,7\n")
+	var got []amountRow
+	err := ReadInBatches(name, 2, func(batch []amountRow) error {
+		got = append(got, batch...)
+		return nil
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "row 5:") {
+		t.Errorf("got %v, want row 5 to fail", err)
+	}
+	if want := []amountRow{{1, 2}, {2, 3}, {3, 4}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want the rows before the error %v", got, want)
+	}
+
+	name = writeFile(t, "id,amount\n1,2\n2,3\n3,4\n\"5,6\n")
+	got = nil
+	err = ReadInBatches(name, 2, func(batch []amountRow) error {
+		got = append(got, batch...)
+		return nil
+	})
+	if err == nil || len(got) != 3 {
+		t.Errorf("parse error got %v with %v", err, got)
+	}
+}
+
+func TestReadInBatches(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("id,amount\n")
+	for i := 1; i <= 250; i++ {
+		fmt.Fprintf(&b, "%d,%d\n", i, i)
+	}
+	name := writeFile(t, b.String())
+
+	sizes := []int{}
+	next := 1
+	err := ReadInBatches(name, 100, func(batch []amountRow) error {
+		sizes = append(sizes, len(batch))
+		for _, r := range batch {
+			if r.ID != next {
+				return fmt.Errorf("got row %d, want %d", r.ID, next)
+			}
+			next++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{100, 100, 50}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("batch sizes %v, want %v", sizes, want)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = ReadInBatches(name, 100, func(batch []amountRow) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("got %v after %d calls, want the error from fn after 1", err, calls)
+	}
+
+	if err := ReadInBatches(name, 0, func([]amountRow) error { return nil }); err == nil {
+		t.Error("batch size 0 accepted")
+	}
+}
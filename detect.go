@@ -0,0 +1,66 @@
+package csvutil
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+)
+
+// detectSampleRows is how many records DetectHeaderRow looks at
+const detectSampleRows = 50
+
+// DetectHeaderRow guesses the index of the header row of filename for
+// Options.HeaderRow. The header is taken to be the first record as wide as
+// most of the sampled records whose cells are all non empty, non numeric and
+// unique. The second result is false, with a row of 0, when no record fits.
+func DetectHeaderRow(filename string) (int, bool, error) {
+	f, err := openFile(filename)
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to read file %s", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(decodeBOM(f))
+	r.FieldsPerRecord = -1
+	records := [][]string{}
+	for len(records) < detectSampleRows {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("unable to parse file as CSV %s", err)
+		}
+		records = append(records, record)
+	}
+
+	widths := map[int]int{}
+	width := 0
+	for _, rec := range records {
+		widths[len(rec)]++
+		if widths[len(rec)] > widths[width] || (widths[len(rec)] == widths[width] && len(rec) > width) {
+			width = len(rec)
+		}
+	}
+
+	for i, rec := range records {
+		if len(rec) == width && looksLikeHeader(rec) {
+			return i, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// looksLikeHeader reports whether every cell of rec is non empty, non numeric
+// and different from the others
+func looksLikeHeader(rec []string) bool {
+	seen := map[string]bool{}
+	for _, cell := range rec {
+		t := cellType(cell)
+		if t == "" || t == "int" || t == "float" || seen[cell] {
+			return false
+		}
+		seen[cell] = true
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+package csvutil
+
+import "testing"
+
+func TestDetectHeaderRow(t *testing.T) {
+	tests := []struct {
+		content string
+		row     int
+		ok      bool
+	}{
+		{"Exported 2024-01-02\nby,ops\nid,name,city\n1,Ada,London\n2,Grace,NYC\n", 2, true},
+		{"id,name\n1,Ada\n", 0, true},
+		{"1,2\n3,4\n", 0, false},
+		{"a,a\nb,b\n", 0, false},
+	}
+	for _, tt := range tests {
+		row, ok, err := DetectHeaderRow(writeFile(t, tt.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row != tt.row || ok != tt.ok {
+			t.Errorf("%q: got %d, %t, want %d, %t", tt.content, row, ok, tt.row, tt.ok)
+		}
+	}
+}
+
+func TestDetectHeaderRowWithHeaderRow(t *testing.T) {
+	name := writeFile(t, "report\n\nname,city\nAda,London\n")
+	row, ok, err := DetectHeaderRow(name)
+	if err != nil || !ok {
+		t.Fatalf("got %d, %t, %v", row, ok, err)
+	}
+	rows, err := ReadToStructWithOptions[excelRow](name, Options{HeaderRow: row})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0] != (excelRow{"Ada", "London"}) {
+		t.Errorf("got %v", rows)
+	}
+}
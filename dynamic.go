@@ -0,0 +1,87 @@
+package csvutil
+
+import (
+	"fmt"
+	"go/token"
+	"reflect"
+)
+
+// DynField describes one field of a row type built at run time for
+// ReadToDynamic
+type DynField struct {
+	// Name is the key of the value in each returned map, it must be an
+	// exported Go identifier
+	Name string
+	// Column is the header the field is read from
+	Column string
+	// Type is the Go type the cell is parsed as, eg. reflect.TypeOf(0)
+	Type reflect.Type
+	// Tag holds any other tags, eg. `time:"2006-01-02"`
+	Tag reflect.StructTag
+}
+
+// Same as ReadToStruct but the row type is described by fields at run time
+// and each row is returned as a map from field name to value
+// eg.
+//
+//	rows, err := ReadToDynamic("data.csv", []DynField{
+//	    {Name: "ID", Column: "id", Type: reflect.TypeOf(0)},
+//	    {Name: "Name", Column: "name", Type: reflect.TypeOf("")},
+//	})
+func ReadToDynamic(filename string, fields []DynField) ([]map[string]any, error) {
+	elem, err := dynamicStruct(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := readFileToArr(filename, Options{}, readState{})
+	if err != nil {
+		return nil, fmt.Errorf("read file error %w", err)
+	}
+	if len(records) == 0 {
+		return nil, ErrNoHeader
+	}
+	conv, err := readColumnDef(elem, records[0], Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	out := []map[string]any{}
+	for _, r := range records[1:] {
+		v, err := conv(r)
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]any, len(fields))
+		for i, f := range fields {
+			row[f.Name] = v.Elem().Field(i).Interface()
+		}
+		out = append(out, row)
+	}
+	return out, nil
+}
+
+// dynamicStruct builds the struct type described by fields, each tagged with
+// its column
+func dynamicStruct(fields []DynField) (reflect.Type, error) {
+	seen := map[string]bool{}
+	sf := make([]reflect.StructField, 0, len(fields))
+	for _, f := range fields {
+		if !token.IsIdentifier(f.Name) || !token.IsExported(f.Name) {
+			return nil, fmt.Errorf("field name %q is not an exported identifier", f.Name)
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("field %s is listed more than once", f.Name)
+		}
+		seen[f.Name] = true
+		if f.Type == nil {
+			return nil, fmt.Errorf("field %s has no type", f.Name)
+		}
+		tag := fmt.Sprintf("col:%q", f.Column)
+		if f.Tag != "" {
+			tag += " " + string(f.Tag)
+		}
+		sf = append(sf, reflect.StructField{Name: f.Name, Type: f.Type, Tag: reflect.StructTag(tag)})
+	}
+	return reflect.StructOf(sf), nil
+}
@@ -0,0 +1,48 @@
+package csvutil
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadToDynamic(t *testing.T) {
+	name := writeFile(t, "id,name\n1,Ada\n2,Grace\n")
+	fields := []DynField{
+		{Name: "ID", Column: "id", Type: reflect.TypeOf(0)},
+		{Name: "Name", Column: "name", Type: reflect.TypeOf("")},
+	}
+	rows, err := ReadToDynamic(name, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]any{{"ID": 1, "Name": "Ada"}, {"ID": 2, "Name": "Grace"}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+
+	if _, err := ReadToDynamic(writeFile(t, "id,name\nx,Ada\n"), fields); err == nil {
+		t.Error("x accepted as an int")
+	}
+}
+
+func TestReadToDynamicBadFields(t *testing.T) {
+	name := writeFile(t, "id\n1\n")
+	tests := []struct {
+		fields []DynField
+		want   string
+	}{
+		{[]DynField{{Name: "id", Column: "id", Type: reflect.TypeOf(0)}}, "not an exported identifier"},
+		{[]DynField{{Name: "ID", Column: "id"}}, "has no type"},
+		{[]DynField{
+			{Name: "ID", Column: "id", Type: reflect.TypeOf(0)},
+			{Name: "ID", Column: "id", Type: reflect.TypeOf(0)},
+		}, "more than once"},
+	}
+	for _, tt := range tests {
+		_, err := ReadToDynamic(name, tt.fields)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want %q", tt.fields, err, tt.want)
+		}
+	}
+}
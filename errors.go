@@ -0,0 +1,69 @@
+package csvutil
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrChecksumMismatch is returned when VerifyChecksum finds the content does
+// not match its checksum trailer.
+var ErrChecksumMismatch = errors.New("csv checksum mismatch")
+
+// ErrNoHeader is returned when reading a CSV with no rows at all, not even
+// a header.
+var ErrNoHeader = errors.New("csv file has no header row")
+
+// ErrLineTooLong is returned when a line of the input is longer than
+// Options.MaxLineBytes.
+var ErrLineTooLong = errors.New("csv line too long")
+
+// ErrNotCSV is returned when Options.SniffContent finds the input is some
+// other format such as HTML or JSON.
+var ErrNotCSV = errors.New("input is not CSV")
+
+// ErrTooManyErrors is returned when reading stops early because
+// Options.MaxErrors rows or cells have failed.
+var ErrTooManyErrors = errors.New("too many errors")
+
+// UnsupportedTypeError is returned when a tagged field has a type that
+// cannot be read from or written to a cell.
+type UnsupportedTypeError struct {
+	Field string
+	Type  reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("field %s has unsupported type %s", e.Field, e.Type)
+}
+
+// RowError is a row ReadToStructCollect could not convert. Row counts records
+// in the file from 1 so the first data row is 2.
+type RowError struct {
+	Row    int
+	Column string
+	Err    error
+}
+
+func (e RowError) Error() string {
+	return fmt.Sprintf("row %d column %s: %s", e.Row, e.Column, e.Err)
+}
+
+func (e RowError) Unwrap() error {
+	return e.Err
+}
+
+// columnError tags err with the column it came from without changing its
+// message
+type columnError struct {
+	Column string
+	Err    error
+}
+
+func (e *columnError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *columnError) Unwrap() error {
+	return e.Err
+}
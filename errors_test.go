@@ -0,0 +1,31 @@
+package csvutil
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type chanRow struct {
+	Events chan int `col:"events"`
+}
+
+func TestUnsupportedTypeError(t *testing.T) {
+	_, err := ReadToStruct[chanRow](writeFile(t, "events\n1\n"))
+	var typeErr *UnsupportedTypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("read got %v, want an UnsupportedTypeError", err)
+	}
+	if typeErr.Field != "Events" || typeErr.Type != reflect.TypeOf(make(chan int)) {
+		t.Errorf("read got %+v", typeErr)
+	}
+
+	err = WriteFromStruct(filepath.Join(t.TempDir(), "out.csv"), []chanRow{{}})
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("write got %v, want an UnsupportedTypeError", err)
+	}
+	if got, want := err.Error(), "field Events has unsupported type chan int"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/chanondw/go-csv
 
-go 1.22.1
+go 1.23
+
+require golang.org/x/text v0.22.0
@@ -0,0 +1,101 @@
+package csvutil
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Read a two column file of property,value rows into a single struct, each
+// property sets the field whose col tag matches it. There is no header row.
+// eg.
+//
+//	host,localhost
+//	port,8080
+//
+// fills
+//
+//	type Config struct {
+//	    Host string `col:"host"`
+//	    Port int    `col:"port"`
+//	}
+func ReadKeyValueToStruct[T any](filename string) (T, error) {
+	return ReadKeyValueToStructWithOptions[T](filename, Options{})
+}
+
+// Same as ReadKeyValueToStruct but parsing is controlled by opts, a property
+// without a matching field is an error unless opts.IgnoreUnknownKeys is set
+func ReadKeyValueToStructWithOptions[T any](filename string, opts Options) (T, error) {
+	var t T
+	str := reflect.ValueOf(&t).Elem()
+	if str.Kind() != reflect.Struct {
+		return t, fmt.Errorf("%s is not struct", str.Type())
+	}
+
+	header, err := headerFields(str.Type())
+	if err != nil {
+		return t, err
+	}
+	fields := map[string]reflect.StructField{}
+	for _, fld := range header {
+		fields[strings.TrimPrefix(fld.Tag.Get("col"), restPrefix)] = fld
+	}
+
+	records, err := readFileToArr(filename, opts, newReadState[T]())
+	if err != nil {
+		return t, fmt.Errorf("read file error %w", err)
+	}
+	for i, r := range records {
+		fld, ok := fields[r[0]]
+		if ok && strings.HasPrefix(fld.Tag.Get("col"), restPrefix) {
+			// the rest field takes every value on its row
+			if len(r) > 1 {
+				str.FieldByIndex(fld.Index).Set(reflect.ValueOf(r[1:]))
+			}
+			continue
+		}
+		if len(r) < 2 {
+			return t, fmt.Errorf("row %d has %d fields, want property and value", i+1, len(r))
+		}
+		if !ok {
+			if opts.IgnoreUnknownKeys {
+				continue
+			}
+			return t, fmt.Errorf("row %d property %s does not exist", i+1, r[0])
+		}
+		if err := setField(str.FieldByIndex(fld.Index), fld, r[1], opts, readState{}); err != nil {
+			return t, fmt.Errorf("row %d: %w", i+1, err)
+		}
+	}
+
+	return t, nil
+}
+
+// Write a single struct as property,value rows, one per col tagged field in
+// field order. A rest field, `col:"...name"`, is one row holding all of its
+// values. This is the inverse of ReadKeyValueToStruct.
+func WriteStructAsKeyValue[T any](filename string, in T) error {
+	str := reflect.ValueOf(in)
+	if str.Kind() != reflect.Struct {
+		return fmt.Errorf("%s is not struct", str.Type())
+	}
+	header, err := headerFields(str.Type())
+	if err != nil {
+		return err
+	}
+
+	out := [][]string{}
+	for _, fld := range header {
+		if name, ok := strings.CutPrefix(fld.Tag.Get("col"), restPrefix); ok {
+			out = append(out, append([]string{name}, str.FieldByIndex(fld.Index).Interface().([]string)...))
+			continue
+		}
+		cell, err := formatField(str.FieldByIndex(fld.Index), fld, Options{})
+		if err != nil {
+			return err
+		}
+		out = append(out, []string{fld.Tag.Get("col"), cell})
+	}
+
+	return writeRecords(filename, out, Options{}, ',')
+}
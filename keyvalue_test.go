@@ -0,0 +1,103 @@
+package csvutil
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type config struct {
+	Host    string        `col:"host"`
+	Port    int           `col:"port"`
+	Debug   bool          `col:"debug"`
+	Timeout time.Duration `col:"timeout"`
+}
+
+func TestReadKeyValueToStruct(t *testing.T) {
+	name := writeFile(t, "host,localhost\nport,8080\ndebug,true\ntimeout,1m30s\n")
+	got, err := ReadKeyValueToStruct[config](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (config{"localhost", 8080, true, 90 * time.Second}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestReadKeyValueUnknownKey(t *testing.T) {
+	name := writeFile(t, "host,localhost\ncolor,blue\n")
+	_, err := ReadKeyValueToStruct[config](name)
+	if err == nil || err.Error() != "row 2 property color does not exist" {
+		t.Errorf("got %v", err)
+	}
+
+	got, err := ReadKeyValueToStructWithOptions[config](name, Options{IgnoreUnknownKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Host != "localhost" {
+		t.Errorf("got %+v", got)
+	}
+
+	_, err = ReadKeyValueToStruct[config](writeFile(t, "port,http\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "row 1: field int Port invalid") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestWriteStructAsKeyValue(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.csv")
+	in := config{"db.local", 5432, false, 2 * time.Second}
+	if err := WriteStructAsKeyValue(name, in); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "host,db.local\nport,5432\ndebug,false\ntimeout,2s\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	back, err := ReadKeyValueToStruct[config](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back != in {
+		t.Errorf("round trip got %+v", back)
+	}
+}
+
+type taggedConfig struct {
+	Host  string   `col:"host"`
+	Peers []string `col:"...peers"`
+	Raw   string   `col:"@raw"`
+	Key   string   `col:"@hash:host"`
+}
+
+func TestKeyValueSkipsPseudoColumns(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.csv")
+	in := taggedConfig{Host: "db.local", Peers: []string{"a", "b"}, Raw: "x", Key: "y"}
+	if err := WriteStructAsKeyValue(name, in); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "host,db.local\npeers,a,b\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	back, err := ReadKeyValueToStruct[taggedConfig](name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (taggedConfig{Host: "db.local", Peers: []string{"a", "b"}}); !reflect.DeepEqual(back, want) {
+		t.Errorf("round trip got %+v, want %+v", back, want)
+	}
+
+	_, err = ReadKeyValueToStruct[taggedConfig](writeFile(t, "host,db.local\n@raw,x\n"))
+	if err == nil || err.Error() != "row 2 property @raw does not exist" {
+		t.Errorf("pseudo column read as a property, got %v", err)
+	}
+
+	back, err = ReadKeyValueToStruct[taggedConfig](writeFile(t, "peers\nhost,db.local\n"))
+	if err != nil || back.Peers != nil {
+		t.Errorf("empty rest row got %+v and %v", back, err)
+	}
+}
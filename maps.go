@@ -0,0 +1,44 @@
+package csvutil
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Write rows of differently shaped maps to CSV. The header is the sorted union
+// of every key, a row without a key gets an empty cell. Values are formatted by
+// their dynamic type the same way WriteFromStruct formats fields.
+func WriteFromAnyMaps(filename string, rows []map[string]any) error {
+	keys := map[string]bool{}
+	for _, r := range rows {
+		for k := range r {
+			keys[k] = true
+		}
+	}
+	header := make([]string, 0, len(keys))
+	for k := range keys {
+		header = append(header, k)
+	}
+	sort.Strings(header)
+
+	out := [][]string{header}
+	for i, r := range rows {
+		row := make([]string, len(header))
+		for j, k := range header {
+			v, ok := r[k]
+			if !ok || v == nil {
+				continue
+			}
+			val := reflect.ValueOf(v)
+			cell, err := formatField(val, reflect.StructField{Name: k, Type: val.Type()}, Options{})
+			if err != nil {
+				return fmt.Errorf("row %d: %w", i+1, err)
+			}
+			row[j] = cell
+		}
+		out = append(out, row)
+	}
+
+	return writeRecords(filename, out, Options{}, ',')
+}
@@ -0,0 +1,22 @@
+package csvutil
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFromAnyMaps(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.csv")
+	rows := []map[string]any{
+		{"name": "Ann", "age": 31},
+		{"name": "Bob", "city": "Oslo", "score": 9.5},
+		{"active": true, "age": nil},
+	}
+	if err := WriteFromAnyMaps(name, rows); err != nil {
+		t.Fatal(err)
+	}
+	want := "active,age,city,name,score\n,31,,Ann,\n,,Oslo,Bob,9.5\ntrue,,,,\n"
+	if got := readFile(t, name); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
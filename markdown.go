@@ -0,0 +1,67 @@
+package csvutil
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Write in as a GitHub flavoured Markdown table using the same columns and
+// cell formatting as WriteFromStruct. An align tag of left, center or right
+// sets the alignment of a column
+// eg.
+//
+//	type Test struct {
+//	    Field1 string  `col:"name"`
+//	    Field2 float64 `col:"price" align:"right"`
+//	}
+func WriteMarkdownTable[T any](w io.Writer, in []T) error {
+	header, err := getStructTagForHeader[T]()
+	if err != nil {
+		return err
+	}
+	out, err := structToRecords(in, Options{})
+	if err != nil {
+		return err
+	}
+
+	sep := make([]string, len(header))
+	for i, fld := range header {
+		switch align := fld.Tag.Get("align"); align {
+		case "":
+			sep[i] = "---"
+		case "left":
+			sep[i] = ":---"
+		case "center":
+			sep[i] = ":---:"
+		case "right":
+			sep[i] = "---:"
+		default:
+			return fmt.Errorf("field %s align tag %s invalid", fld.Name, align)
+		}
+	}
+
+	var b strings.Builder
+	writeMarkdownRow(&b, out[0])
+	writeMarkdownRow(&b, sep)
+	for _, row := range out[1:] {
+		writeMarkdownRow(&b, row)
+	}
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("write error %w", err)
+	}
+	return nil
+}
+
+// markdownEscaper keeps a cell on one line and inside its column
+var markdownEscaper = strings.NewReplacer("|", `\|`, "\r\n", "<br>", "\n", "<br>")
+
+func writeMarkdownRow(b *strings.Builder, row []string) {
+	b.WriteString("|")
+	for _, cell := range row {
+		b.WriteString(" ")
+		b.WriteString(markdownEscaper.Replace(cell))
+		b.WriteString(" |")
+	}
+	b.WriteString("\n")
+}
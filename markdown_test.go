@@ -0,0 +1,41 @@
+package csvutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteMarkdownTable(t *testing.T) {
+	type product struct {
+		Name  string  `col:"name" align:"left"`
+		Note  string  `col:"note"`
+		Price float64 `col:"price" align:"right"`
+		Stock int     `col:"stock" align:"center"`
+	}
+	var b strings.Builder
+	err := WriteMarkdownTable(&b, []product{{"tea", "a|b", 2.5, 10}, {"cake", "two\nlines", 4, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "| name | note | price | stock |\n" +
+		"| :--- | --- | ---: | :---: |\n" +
+		"| tea | a\\|b | 2.5 | 10 |\n" +
+		"| cake | two<br>lines | 4 | 0 |\n"
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestWriteMarkdownTableBadAlign(t *testing.T) {
+	type row struct {
+		Name string `col:"name" align:"middle"`
+	}
+	var b strings.Builder
+	err := WriteMarkdownTable(&b, []row{{"x"}})
+	if err == nil || !strings.Contains(err.Error(), "align tag middle invalid") {
+		t.Errorf("got %v", err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("wrote %q before failing", b.String())
+	}
+}
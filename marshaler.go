@@ -0,0 +1,54 @@
+package csvutil
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// CSVUnmarshaler is implemented by field types that parse their own cell, eg.
+// a money type reading "$1,234.56" as cents. It is checked on the field and its
+// pointer before any of the builtin conversions.
+type CSVUnmarshaler interface {
+	UnmarshalCSV(cell string) error
+}
+
+// CSVMarshaler is implemented by field types that format their own cell
+type CSVMarshaler interface {
+	MarshalCSV() (string, error)
+}
+
+var (
+	unmarshalerType = reflect.TypeOf((*CSVUnmarshaler)(nil)).Elem()
+	marshalerType   = reflect.TypeOf((*CSVMarshaler)(nil)).Elem()
+)
+
+// unmarshalCSV calls UnmarshalCSV when field implements CSVUnmarshaler and
+// reports whether it did
+func unmarshalCSV(field reflect.Value, name string, cell string) (bool, error) {
+	if !field.CanAddr() || !field.Addr().Type().Implements(unmarshalerType) {
+		return false, nil
+	}
+	if err := field.Addr().Interface().(CSVUnmarshaler).UnmarshalCSV(cell); err != nil {
+		return true, fmt.Errorf("field %s invalid: %w", name, err)
+	}
+	return true, nil
+}
+
+// marshalCSV calls MarshalCSV when field implements CSVMarshaler and reports
+// whether it did. field is copied when it is not addressable so methods on
+// the pointer are found too.
+func marshalCSV(field reflect.Value, name string) (string, bool, error) {
+	if !field.Type().Implements(marshalerType) && !reflect.PointerTo(field.Type()).Implements(marshalerType) {
+		return "", false, nil
+	}
+	if !field.CanAddr() {
+		v := reflect.New(field.Type()).Elem()
+		v.Set(field)
+		field = v
+	}
+	cell, err := field.Addr().Interface().(CSVMarshaler).MarshalCSV()
+	if err != nil {
+		return "", true, fmt.Errorf("field %s invalid: %w", name, err)
+	}
+	return cell, true, nil
+}
@@ -0,0 +1,55 @@
+package csvutil
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// cents is a money amount read from and written as "$1,234.56"
+type cents int64
+
+func (c *cents) UnmarshalCSV(cell string) error {
+	n, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimPrefix(cell, "$"), ",", ""), 64)
+	if err != nil {
+		return err
+	}
+	*c = cents(n*100 + 0.5)
+	return nil
+}
+
+func (c cents) MarshalCSV() (string, error) {
+	return fmt.Sprintf("$%d.%02d", c/100, c%100), nil
+}
+
+type moneyRow struct {
+	Price cents  `col:"price"`
+	Tax   *cents `col:"tax"`
+}
+
+func TestCSVMarshaler(t *testing.T) {
+	rows, err := ReadToStruct[moneyRow](writeFile(t, "price,tax\n\"$1,234.56\",$0.10\n$2.00,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tax := cents(10)
+	if want := []moneyRow{{123456, &tax}, {200, nil}}; !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got %v, want %v", rows, want)
+	}
+
+	name := filepath.Join(t.TempDir(), "out.csv")
+	if err := WriteFromStruct(name, rows); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, name), "price,tax\n$1234.56,$0.10\n$2.00,\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err = ReadToStruct[moneyRow](writeFile(t, "price,tax\nfree,\n"))
+	if err == nil || !strings.Contains(err.Error(), "field Price invalid") {
+		t.Errorf("got %v", err)
+	}
+}
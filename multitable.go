@@ -0,0 +1,76 @@
+package csvutil
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Table is one header and its rows from a file read by ReadMultiTable
+type Table struct {
+	Header []string
+	Rows   [][]string
+}
+
+// Read a file holding several tables one after another, each with its own
+// header and separated by one or more blank lines. A blank line inside a quoted
+// field does not end the table. Map a table with RowsToStructs.
+func ReadMultiTable(filename string) ([]Table, error) {
+	f, err := openFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read file error unable to read file %w", err)
+	}
+	defer f.Close()
+
+	tables := []Table{}
+	var block strings.Builder
+	quotes := 0
+	flush := func() error {
+		if block.Len() == 0 {
+			return nil
+		}
+		records, err := csv.NewReader(strings.NewReader(block.String())).ReadAll()
+		block.Reset()
+		if err != nil {
+			return fmt.Errorf("unable to parse table %d as CSV %s", len(tables)+1, err)
+		}
+		tables = append(tables, Table{Header: records[0], Rows: records[1:]})
+		return nil
+	}
+
+	// a bufio.Scanner would fail on lines over 64 KiB
+	br := bufio.NewReader(decodeBOM(f))
+	for {
+		line, readErr := br.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return nil, fmt.Errorf("read file error %w", readErr)
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if strings.TrimSpace(line) == "" && quotes%2 == 0 {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		} else {
+			quotes += strings.Count(line, `"`)
+			block.WriteString(line)
+			block.WriteByte('\n')
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// Same as ReadToStruct but the header and rows are already parsed, eg. a Table
+// from ReadMultiTable
+func RowsToStructs[T any](header []string, rows [][]string) ([]T, error) {
+	records := append([][]string{header}, rows...)
+	return recordsToStruct[T](context.Background(), records, Options{}, readState{})
+}
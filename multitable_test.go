@@ -0,0 +1,48 @@
+package csvutil
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadMultiTable(t *testing.T) {
+	name := writeFile(t, "id,amount\r\n1,2\r\n\r\n\r\nname,city\nAda,\"London\n\nUK\"\n")
+	tables, err := ReadMultiTable(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Table{
+		{Header: []string{"id", "amount"}, Rows: [][]string{{"1", "2"}}},
+		{Header: []string{"name", "city"}, Rows: [][]string{{"Ada", "London\n\nUK"}}},
+	}
+	if !reflect.DeepEqual(tables, want) {
+		t.Fatalf("got %q, want %q", tables, want)
+	}
+
+	rows, err := RowsToStructs[amountRow](tables[0].Header, tables[0].Rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []amountRow{{1, 2}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
+
+func TestReadMultiTableLongLine(t *testing.T) {
+	long := strings.Repeat("x", 100*1024)
+	tables, err := ReadMultiTable(writeFile(t, "id,note\n1,"+long))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 || len(tables[0].Rows) != 1 || tables[0].Rows[0][1] != long {
+		t.Errorf("long line not read back, got %d tables", len(tables))
+	}
+}
+
+func TestReadMultiTableBadTable(t *testing.T) {
+	_, err := ReadMultiTable(writeFile(t, "a,b\n1,2\n\nc,d\n3\n"))
+	if err == nil || !strings.Contains(err.Error(), "unable to parse table 2") {
+		t.Errorf("got %v", err)
+	}
+}
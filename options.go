@@ -0,0 +1,418 @@
+package csvutil
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const utf8BOM = "\ufeff"
+
+// checksumPrefix starts the trailer line written by WriteChecksum
+const checksumPrefix = "#sha256:"
+
+// EmptyHeaderMode is how Options.EmptyHeaders treats unnamed header cells
+type EmptyHeaderMode int
+
+const (
+	// EmptyHeaderKeep leaves empty names as they are, no field can map to them
+	EmptyHeaderKeep EmptyHeaderMode = iota
+	// EmptyHeaderError fails the read
+	EmptyHeaderError
+	// EmptyHeaderName names them column_<n> counted from 1, eg. column_3
+	EmptyHeaderName
+)
+
+// HeaderMatch is how Options.HeaderMatch compares col tags to header names
+type HeaderMatch int
+
+const (
+	// HeaderMatchExact needs the header and tag to be identical
+	HeaderMatchExact HeaderMatch = iota
+	// HeaderMatchNormalized trims surrounding whitespace from both and
+	// ignores case, so " Customer Name " matches `col:"customer name"`
+	HeaderMatchNormalized
+)
+
+// NilElementMode is how Options.NilElements writes a nil element of a []*T
+type NilElementMode int
+
+const (
+	// NilElementError fails the write
+	NilElementError NilElementMode = iota
+	// NilElementSkip leaves the element out
+	NilElementSkip
+	// NilElementEmpty writes a row of empty cells
+	NilElementEmpty
+)
+
+// Aggregate is how Options.Aggregates summarises a column
+type Aggregate int
+
+const (
+	// AggregateSum adds up the column
+	AggregateSum Aggregate = iota + 1
+	// AggregateAvg is the mean of the column
+	AggregateAvg
+	// AggregateCount is the number of non empty cells
+	AggregateCount
+)
+
+// Options changes how the *WithOptions variants read and write CSV.
+// The zero value behaves the same as ReadToStruct and WriteFromStruct.
+type Options struct {
+	// Comma is the field delimiter, eg. ';' or '\t' for TSV. Fields holding
+	// it are quoted on write and a quoted field keeps it on read, so a TSV
+	// cell may contain tabs. Zero means ','.
+	Comma rune
+	// HeaderComma is the delimiter of the header row when it differs from
+	// the data, eg. '\t' for a tab separated header over comma separated
+	// rows. Zero uses Comma. It is ignored with RecordSeparator.
+	HeaderComma rune
+	// SniffContent fails with ErrNotCSV when the input starts with "<" or
+	// "{", eg. an HTML error page or JSON saved in place of the CSV.
+	SniffContent bool
+	// RecordSeparator ends each record instead of a line break, eg. '|'.
+	// A quoted field can hold the delimiter or a line break but never the
+	// record separator, the input is split on it before any parsing.
+	RecordSeparator rune
+	// Comment starts a line skipped on read when it is the first character,
+	// zero disables comments. It has no effect on write.
+	Comment rune
+	// EnumFold matches cells against an `enum` tag case-insensitively.
+	// The value stored in the field is always the spelling from the tag.
+	EnumFold bool
+	// RetryOpen retries opening the file this many times on errors other
+	// than not existing or permission denied, eg. a flaky network mount.
+	RetryOpen int
+	// RetryBackoff is the wait before the first retry, doubled after each.
+	RetryBackoff time.Duration
+	// MaxLineBytes fails the read with ErrLineTooLong on the first line
+	// longer than this many bytes, as soon as it is reached, so a hostile
+	// file can not make the reader buffer it all. Zero means no limit.
+	MaxLineBytes int
+	// MaxRows stops reading once this many data rows have been returned,
+	// zero reads them all. Rows dropped by OnError or TimeRangeField do not
+	// count, the failed rows returned by ReadToStructPartial do.
+	MaxRows int
+	// ReuseRecord lets a StructReader read every row into the same []string,
+	// saving an allocation per row. The slice returned by Record is then
+	// only valid until the next Read. The rows returned are not affected.
+	ReuseRecord bool
+	// StripCellBOM removes byte order marks from the start of every cell,
+	// header included, left by files joined together without stripping
+	// their own. The BOM at the start of the file is always removed.
+	StripCellBOM bool
+	// TimeRangeField names a time.Time field, rows whose value is before
+	// TimeFrom or after TimeTo are skipped as they are read. A zero bound is
+	// open. MaxRows counts the rows kept.
+	TimeRangeField string
+	TimeFrom       time.Time
+	TimeTo         time.Time
+	// NormalizeUnicodeSpace replaces Unicode spaces such as the non breaking
+	// space U+00A0 with ASCII spaces and trims each cell before parsing.
+	NormalizeUnicodeSpace bool
+	// TrimQuotes lists quote like characters, eg. "“”", stripped from the
+	// start and end of each cell before parsing. They are not CSV quotes.
+	TrimQuotes string
+	// InternStrings stores one copy of each distinct string cell, shared by
+	// every field holding it. It costs a map lookup per cell so is only
+	// worth it when most string columns have few distinct values, tag
+	// single columns `intern:"true"` otherwise.
+	InternStrings bool
+	// LowercaseStrings lowercases the value of every string field. Enum
+	// fields still get the spelling from their tag.
+	LowercaseStrings bool
+	// ValueRemap replaces whole cell values of the keyed columns before
+	// parsing, eg. {"country": {"USA": "US", "U.S.A.": "US"}}. Values not
+	// listed are kept.
+	ValueRemap map[string]map[string]string
+	// CurrencyColumns maps a column name to its currency symbol, eg. "$".
+	// The symbol and "," grouping are removed before parsing so
+	// "$1,234.50" reads as 1234.50.
+	CurrencyColumns map[string]string
+	// NumberFormats maps a column name to the separators its numbers use,
+	// for files mixing locales, eg. {"price_de": {Group: '.', Decimal: ','}}
+	// reads "1.234,56" as 1234.56. Other columns are read as usual.
+	NumberFormats map[string]NumberFormat
+	// PercentColumns lists columns whose trailing "%" is removed before
+	// parsing, "12.5%" reads as 12.5.
+	PercentColumns map[string]bool
+	// StrictNumbers only accepts plain decimal numbers in numeric fields
+	// once any stripping is done, rejecting eg. "0x1F", "Inf" or "1_000"
+	// and naming the junk left in a cell such as "12 (approx)".
+	StrictNumbers bool
+	// StripLeadingZeros trims spaces and leading zeros from numeric cells
+	// padded to a fixed width, eg. "  00042" reads as 42.
+	StripLeadingZeros bool
+	// AccountingNegatives reads a numeric cell in parentheses, eg.
+	// "(1,234.50)", as negative, ignoring "," grouping inside them, and
+	// writes negative numbers the same way.
+	AccountingNegatives bool
+	// HeaderRow is the number of records above the header that are
+	// skipped, eg. a title line, see DetectHeaderRow.
+	HeaderRow int
+	// AutoMatchSnakeCase reads exported fields without a col tag from the
+	// header matching their name in snake_case, ignoring case, so FirstName
+	// reads first_name. A field with no such header is left alone. Writing
+	// still only uses col tags.
+	AutoMatchSnakeCase bool
+	// ColumnMap reads the named Go field from the keyed header instead of
+	// the column in its col tag, eg. {"Customer Name": "Name"}.
+	ColumnMap map[string]string
+	// Strict fails the read unless the header has every tagged column and
+	// nothing else, listing all the missing and unexpected columns at once.
+	Strict bool
+	// HeaderMatch decides how col tags are matched to header names, exact
+	// by default.
+	HeaderMatch HeaderMatch
+	// EmptyHeaders decides what happens to header cells with no name, eg.
+	// from a trailing comma. By default they are left as they are.
+	EmptyHeaders EmptyHeaderMode
+	// Continuation reports whether row continues the logical record prev,
+	// eg. its key column is blank. Such rows are merged into prev before
+	// conversion, each non empty cell appended to the same cell of prev
+	// separated by a newline.
+	Continuation func(prev, row []string) bool
+	// StrictRowWidth rejects any record whose field count is not the
+	// header width. The CSV parser already enforces this for physical rows
+	// unless PadShortRows is set, this also covers short rows let through
+	// by it and records built by Continuation.
+	StrictRowWidth bool
+	// PadShortRows accepts rows with fewer fields than the header, as
+	// written by tools that drop trailing empty cells. Fields whose column
+	// is missing keep their zero value unless tagged `required:"true"`.
+	// Rows with more fields than the header are still an error unless T
+	// has a rest field.
+	PadShortRows bool
+	// Derived computes struct fields that have no source column. Keys are
+	// field names, each function is called with a *T after the mapped
+	// columns are set and its result is assigned to the field. Functions
+	// run in no particular order so should not depend on each other.
+	Derived map[string]func(rec any) (any, error)
+	// SourceColumn names a string field set to the file each row was read
+	// from, useful with ReadToStructGlob.
+	SourceColumn string
+	// PreValidateTypes checks every mapped cell parses into its field before
+	// any struct is built, reporting all the bad cells at once.
+	PreValidateTypes bool
+	// OnError is called with the row number, counting the header as row 1,
+	// and the error of each row that fails to convert. Returning true skips
+	// the row and carries on, false stops the read with that error.
+	OnError func(row int, err error) bool
+	// TypeConsistencyCheck infers each column's type, int, float, bool or
+	// string, from the first data row and fails on the first later cell of
+	// another type. An int cell is accepted in a float column. A column read
+	// by a field tagged `preserve:"true"` is always a string, as is one whose
+	// cells are all quoted, eg. "00042", unless CoerceQuotedNumbers is set.
+	TypeConsistencyCheck bool
+	// CoerceQuotedNumbers infers the type of quoted cells from their value
+	// like any other for TypeConsistencyCheck.
+	CoerceQuotedNumbers bool
+	// MaxErrors stops ReadToStructPartialWithOptions,
+	// ReadToStructCollectWithOptions and PreValidateTypes as soon as this
+	// many errors are collected, zero collects them all.
+	MaxErrors int
+	// IgnoreUnknownKeys skips properties with no matching field in
+	// ReadKeyValueToStructWithOptions instead of failing.
+	IgnoreUnknownKeys bool
+	// RecoverPanics turns a panic while converting a row, eg. a col tag on
+	// an unexported field, into an error for that row instead of crashing.
+	RecoverPanics bool
+	// VerifyChecksum requires the file to end with the trailer written by
+	// WriteChecksum, checks it against the content and strips it.
+	VerifyChecksum bool
+
+	// PreviewTo gets an aligned preview of the header and first PreviewRows
+	// rows, 10 when zero, as "# " comment lines, eg. for a log. The CSV is
+	// still written in full.
+	PreviewTo   io.Writer
+	PreviewRows int
+	// BOM writes a UTF-8 byte order mark before the header.
+	BOM bool
+	// UseCRLF ends each written row with \r\n instead of \n.
+	UseCRLF bool
+	// BufferSize buffers output in a bufio.Writer of this many bytes ahead
+	// of the CSV writer's own small buffer, fewer writes to the file for
+	// large outputs. Zero leaves only the CSV writer's buffer.
+	BufferSize int
+	// WriteTypeRow writes a second row after the header naming the type of
+	// each column, one of string, int, uint, float, bool, time, duration,
+	// slice or map.
+	WriteTypeRow bool
+	// WriteChecksum appends a last line holding "#sha256:" and the hex
+	// SHA-256 of every byte written before it.
+	WriteChecksum bool
+	// ValidateUTF8 refuses to write a cell that is not valid UTF-8 and
+	// guarantees the output has no BOM, so it can not be used with BOM.
+	ValidateUTF8 bool
+	// EmptySentinelRow writes one row of empty cells after the header when
+	// there are no rows, for importers that reject a header on its own. With
+	// a single column the row is written as "" so it is not a blank line.
+	EmptySentinelRow bool
+	// WriteWorkers formats rows on this many goroutines before writing them
+	// in order, worth it for large slices with costly fields. ExpandFields,
+	// ComputedColumns, CellTransform and CSVMarshaler implementations must
+	// then be safe to call concurrently.
+	WriteWorkers int
+	// HeaderTransform rewrites each written header name, eg. UpperCaseHeader
+	// or TitleCaseHeader. Other options still refer to the names from the
+	// tags.
+	HeaderTransform func(header string) string
+	// NilElements decides what happens to nil elements when writing a []*T.
+	// By default they fail the write.
+	NilElements NilElementMode
+	// ComputedColumns are written after the tagged columns, in order.
+	ComputedColumns []ComputedColumn
+	// TemplateColumns are written after ComputedColumns, in order.
+	TemplateColumns []TemplateColumn
+	// CellTransform is called with the column name and formatted value of
+	// every data cell written and its result written instead, eg. to mask
+	// an email column with "***".
+	CellTransform func(column, value string) string
+	// SanitizeFormulas prefixes data cells starting with '=', '+', '-', '@',
+	// a tab or carriage return with FormulaEscape so spreadsheets show them
+	// as text instead of running them, eg. "=SUM(A1)" is written as
+	// "'=SUM(A1)". Numbers such as -5 are not changed, nor is any cell of a
+	// numeric field, eg. "-1,234" written with a group tag.
+	SanitizeFormulas bool
+	// FormulaEscape is the prefix used by SanitizeFormulas, "'" when empty.
+	FormulaEscape string
+	// Aggregates appends a last row summarising the keyed columns, eg.
+	// {"amount": AggregateSum}. Other columns are blank but the first of
+	// them holds AggregateLabel. A rest field and the columns after it can
+	// not be aggregated.
+	Aggregates map[string]Aggregate
+	// AggregateLabel is written in the aggregate row, eg. "Total"
+	AggregateLabel string
+	// ExpandFields writes the keyed fields as several columns in place of
+	// their own. Reading does not join them back, use a cols tag or
+	// Derived for that.
+	ExpandFields map[string]FieldExpander
+	// DurationUnit writes time.Duration fields as a count of this unit, eg.
+	// time.Second writes 90m as 5400, and reads them back the same way.
+	// When zero they are written as "1h30m0s".
+	DurationUnit time.Duration
+	// FloatFormat is the strconv.FormatFloat format, eg. 'f', 'e' or 'g',
+	// of every float field, 'f' when zero. Per field `fmt` and `prec` tags
+	// win.
+	FloatFormat byte
+	// FloatPrecision is the number of digits written with FloatFormat. When
+	// nil it is -1, the fewest digits that read back exactly, so 0.1 stays
+	// 0.1 and not 0 or 0.10000000000000001.
+	FloatPrecision *int
+	// NullString is written for nil pointer fields, for NaN floats when
+	// NaNAsNull is set and zero times when ZeroTimeAsNull is set. Defaults
+	// to an empty cell. On read a pointer field is left nil for an empty
+	// cell or NullString.
+	NullString string
+	// NaNAsNull writes NaN floats as NullString instead of "NaN".
+	NaNAsNull bool
+	// ZeroTimeAsNull writes the zero time.Time as NullString instead of
+	// eg. "0001-01-01T00:00:00Z".
+	ZeroTimeAsNull bool
+}
+
+// UpperCaseHeader is a HeaderTransform writing headers in upper case, eg.
+// "first_name" is "FIRST_NAME"
+func UpperCaseHeader(header string) string {
+	return strings.ToUpper(header)
+}
+
+// TitleCaseHeader is a HeaderTransform upper casing the first letter of each
+// word, words being separated by spaces, "_" or "-", eg. "first name" is
+// "First Name" and "first_name" is "First_Name"
+func TitleCaseHeader(header string) string {
+	runes := []rune(header)
+	for i, r := range runes {
+		if i == 0 || strings.ContainsRune(" _-", runes[i-1]) {
+			runes[i] = unicode.ToUpper(r)
+		}
+	}
+	return string(runes)
+}
+
+// comma is the field delimiter set by o, ',' when unset
+func (o Options) comma() rune {
+	if o.Comma == 0 {
+		return ','
+	}
+	return o.Comma
+}
+
+// validateDelimiter rejects a field delimiter that csv can not use, checked
+// before any file is touched so a bad delimiter does not truncate output.
+// The quote character is always '"'.
+func validateDelimiter(comma rune) error {
+	switch {
+	case comma == '"':
+		return fmt.Errorf("delimiter %q is the same as the quote character", comma)
+	case comma == '\n' || comma == '\r':
+		return fmt.Errorf("delimiter %q is a line break", comma)
+	case comma == utf8.RuneError || !utf8.ValidRune(comma):
+		return fmt.Errorf("delimiter %q is not a valid character", comma)
+	}
+	return nil
+}
+
+// ComputedColumn is an output column with no struct field behind it
+// eg.
+//
+//	ComputedColumn{Header: "full_name", Value: func(rec any) string {
+//	    p := rec.(Person)
+//	    return p.First + " " + p.Last
+//	}}
+type ComputedColumn struct {
+	Header string
+	// Value is called with each element being written, a T not a *T even
+	// when writing a []*T
+	Value func(rec any) string
+}
+
+// TemplateColumn is an output column rendered by executing Template with each
+// element being written, a T not a *T even when writing a []*T
+// eg.
+//
+//	TemplateColumn{Header: "label", Template: template.Must(template.New("label").Parse(
+//	    `{{.Name}} ({{printf "%.2f" .Price}})`))}
+type TemplateColumn struct {
+	Header   string
+	Template *template.Template
+}
+
+// NumberFormat is the grouping and decimal separators of a column's numbers
+type NumberFormat struct {
+	// Group separates thousands, removed before parsing. Zero means none.
+	Group rune
+	// Decimal is the decimal point, zero means '.'.
+	Decimal rune
+}
+
+// normalize rewrites cell with no grouping and a '.' decimal point
+func (f NumberFormat) normalize(cell string) string {
+	if f.Group != 0 {
+		cell = strings.ReplaceAll(cell, string(f.Group), "")
+	}
+	if f.Decimal != 0 && f.Decimal != '.' {
+		cell = strings.ReplaceAll(cell, string(f.Decimal), ".")
+	}
+	return cell
+}
+
+// FieldExpander splits one field into the columns named by Headers
+// eg.
+//
+//	FieldExpander{Headers: []string{"first", "last"}, Split: func(v any) []string {
+//	    first, last, _ := strings.Cut(v.(string), " ")
+//	    return []string{first, last}
+//	}}
+type FieldExpander struct {
+	Headers []string
+	// Split is called with the field value and must return one cell per
+	// header
+	Split func(v any) []string
+}
@@ -0,0 +1,65 @@
+package csvutil
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateDelimiter(t *testing.T) {
+	tests := []struct {
+		comma rune
+		want  string
+	}{
+		{'"', "is the same as the quote character"},
+		{'\n', "is a line break"},
+		{'\r', "is a line break"},
+		{0xFFFD, "is not a valid character"},
+		{';', ""},
+		{'\t', ""},
+	}
+	for _, tt := range tests {
+		err := validateDelimiter(tt.comma)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%q: %v", tt.comma, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.comma, err, tt.want)
+		}
+	}
+}
+
+func TestDelimiterCheckedBeforeIO(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "missing.csv")
+	err := WriteFromStructWithOptions(name, []excelRow{}, Options{Comma: '"'})
+	if err == nil || !strings.Contains(err.Error(), "quote character") {
+		t.Errorf("write got %v", err)
+	}
+	_, err = ReadToStructWithOptions[excelRow](writeFile(t, "name,city\n"), Options{Comma: '\n'})
+	if err == nil || !strings.Contains(err.Error(), "line break") {
+		t.Errorf("read got %v", err)
+	}
+}
+
+func TestHeaderPresets(t *testing.T) {
+	tests := []struct {
+		in, upper, title string
+	}{
+		{"first_name", "FIRST_NAME", "First_Name"},
+		{"first name", "FIRST NAME", "First Name"},
+		{"e-mail", "E-MAIL", "E-Mail"},
+		{"élan", "ÉLAN", "Élan"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := UpperCaseHeader(tt.in); got != tt.upper {
+			t.Errorf("UpperCaseHeader(%q) = %q, want %q", tt.in, got, tt.upper)
+		}
+		if got := TitleCaseHeader(tt.in); got != tt.title {
+			t.Errorf("TitleCaseHeader(%q) = %q, want %q", tt.in, got, tt.title)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package csvutil
+
+import (
+	"fmt"
+	"io"
+	"iter"
+	"reflect"
+	"time"
+)
+
+// StructReader converts the records of a CSV stream into T one at a time so
+// memory use does not grow with the size of the input
+// eg.
+//
+//	sr, err := NewStructReader[Test](f)
+//	if err != nil {
+//	    return err
+//	}
+//	for {
+//	    t, err := sr.Read()
+//	    if err == io.EOF {
+//	        break
+//	    }
+//	    if err != nil {
+//	        return err
+//	    }
+//	}
+type StructReader[T any] struct {
+	r         *recordReader
+	conv      func(row []string) (*T, error)
+	opts      Options
+	timeIndex []int
+	row       []string
+	n         int
+	kept      int
+}
+
+// Read the header of r and build the column mapping for T
+func NewStructReader[T any](r io.Reader) (*StructReader[T], error) {
+	return NewStructReaderWithOptions[T](r, Options{})
+}
+
+// Same as NewStructReader but parsing is controlled by opts. Options that need
+// the whole input, RecordSeparator, VerifyChecksum, Continuation,
+// TypeConsistencyCheck and PreValidateTypes, are rejected with an error.
+func NewStructReaderWithOptions[T any](r io.Reader, opts Options) (*StructReader[T], error) {
+	if name := wholeInputOption(opts); name != "" {
+		return nil, fmt.Errorf("%s needs the whole input, it is not supported by StructReader", name)
+	}
+	r, err := inputReader(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	rr, err := newRecordReader(&trailingBlankReader{r: r}, opts, newReadState[T]())
+	if err != nil {
+		return nil, err
+	}
+	if rr.header == nil {
+		return nil, ErrNoHeader
+	}
+	// set once the header is read, the column names are looked up while
+	// converting after the slice may have been reused for a data row
+	rr.ReuseRecord = opts.ReuseRecord
+	if err := nameEmptyHeaders(rr.header, opts.EmptyHeaders); err != nil {
+		return nil, err
+	}
+
+	conv, err := readColumnDefCreateStruct[T](rr.header, opts)
+	if err != nil {
+		return nil, err
+	}
+	timeIndex, err := timeRangeIndex[T](opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StructReader[T]{r: rr, conv: conv, opts: opts, timeIndex: timeIndex, n: 1}, nil
+}
+
+// wholeInputOption is the name of the first option set in opts that can only
+// be applied to the whole input at once, empty when there is none
+func wholeInputOption(opts Options) string {
+	switch {
+	case opts.RecordSeparator != 0:
+		return "RecordSeparator"
+	case opts.VerifyChecksum:
+		return "VerifyChecksum"
+	case opts.Continuation != nil:
+		return "Continuation"
+	case opts.TypeConsistencyCheck:
+		return "TypeConsistencyCheck"
+	case opts.PreValidateTypes:
+		return "PreValidateTypes"
+	}
+	return ""
+}
+
+// Read returns the next row, io.EOF once the input is exhausted or
+// Options.MaxRows rows have been returned
+func (sr *StructReader[T]) Read() (T, error) {
+	t, _, err := sr.read()
+	return t, err
+}
+
+// Record returns the cells of the row last read. With Options.ReuseRecord the
+// slice is overwritten by the next Read, copy it to keep it.
+func (sr *StructReader[T]) Record() []string {
+	return sr.row
+}
+
+// read is Read also reporting whether err came from parsing the CSV itself,
+// after which no more rows can be read. Rows skipped by Options.OnError or
+// outside the time range are passed over.
+func (sr *StructReader[T]) read() (T, bool, error) {
+	var t T
+	for {
+		if sr.opts.MaxRows > 0 && sr.kept == sr.opts.MaxRows {
+			return t, true, io.EOF
+		}
+		row, err := sr.r.next()
+		if err == io.EOF {
+			return t, true, io.EOF
+		}
+		if err != nil {
+			return t, true, fmt.Errorf("unable to parse file as CSV %w", err)
+		}
+		sr.n++
+		sr.row = row
+
+		if sr.opts.StrictRowWidth && len(row) != len(sr.r.header) {
+			err := fmt.Errorf("row %d has %d fields, header has %d", sr.n, len(row), len(sr.r.header))
+			if sr.opts.OnError != nil && sr.opts.OnError(sr.n, err) {
+				continue
+			}
+			return t, false, err
+		}
+		elem, err := convertRow(sr.conv, row, sr.opts.RecoverPanics)
+		if err != nil {
+			if sr.opts.OnError != nil && sr.opts.OnError(sr.n, err) {
+				continue
+			}
+			return t, false, fmt.Errorf("row %d: %w", sr.n, err)
+		}
+		if sr.timeIndex != nil && !inTimeRange(reflect.ValueOf(elem).Elem().FieldByIndex(sr.timeIndex).Interface().(time.Time), sr.opts) {
+			continue
+		}
+		sr.kept++
+		return *elem, false, nil
+	}
+}
+
+// ReadSeq yields each row of r as it is read, for use with range. A row that
+// can not be converted yields its error and reading carries on, the sequence
+// ends after a CSV syntax error or when the loop stops. r is read from as the
+// loop runs so the sequence can only be ranged over once
+// eg.
+//
+//	for t, err := range ReadSeq[Test](f) {
+//	    if err != nil {
+//	        return err
+//	    }
+//	}
+func ReadSeq[T any](r io.Reader) iter.Seq2[T, error] {
+	return ReadSeqWithOptions[T](r, Options{})
+}
+
+// Same as ReadSeq but parsing is controlled by opts as for
+// NewStructReaderWithOptions
+func ReadSeqWithOptions[T any](r io.Reader, opts Options) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		sr, err := NewStructReaderWithOptions[T](r, opts)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		for {
+			t, fatal, err := sr.read()
+			if err == io.EOF {
+				return
+			}
+			if !yield(t, err) || fatal {
+				return
+			}
+		}
+	}
+}
+
+// Same as ReadSeq but filename is opened when the loop starts and closed when
+// it ends, including when it stops early
+func ReadFileSeq[T any](filename string) iter.Seq2[T, error] {
+	return ReadFileSeqWithOptions[T](filename, Options{})
+}
+
+// Same as ReadFileSeq but parsing is controlled by opts as for
+// NewStructReaderWithOptions
+func ReadFileSeqWithOptions[T any](filename string, opts Options) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		f, err := openWithRetry(filename, opts)
+		if err != nil {
+			var zero T
+			yield(zero, fmt.Errorf("unable to read file %s", err))
+			return
+		}
+		defer f.Close()
+		for t, err := range ReadSeqWithOptions[T](f, opts) {
+			if !yield(t, err) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package csvutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rowStream generates a header and rows data rows of id,amount without ever
+// holding more than one row, standing in for a file too big for memory
+type rowStream struct {
+	rows int
+	n    int
+	buf  []byte
+}
+
+func (s *rowStream) Read(p []byte) (int, error) {
+	if len(s.buf) == 0 {
+		if s.n > s.rows {
+			return 0, io.EOF
+		}
+		if s.n == 0 {
+			s.buf = []byte("id,amount\n")
+		} else {
+			s.buf = fmt.Appendf(s.buf, "%d,%d.5\n", s.n, s.n)
+		}
+		s.n++
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func TestStructReader(t *testing.T) {
+	const rows = 200000
+	sr, err := NewStructReader[amountRow](&rowStream{rows: rows})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 1
+	for {
+		r, err := sr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.ID != want || r.Amount != float64(want)+0.5 {
+			t.Fatalf("got %v, want row %d", r, want)
+		}
+		want++
+	}
+	if want != rows+1 {
+		t.Errorf("got %d rows, want %d", want-1, rows)
+	}
+}
+
+func TestStructReaderErrors(t *testing.T) {
+	if _, err := NewStructReader[amountRow](strings.NewReader("")); err != ErrNoHeader {
+		t.Errorf("empty input got %v", err)
+	}
+
+	sr, err := NewStructReader[amountRow](strings.NewReader("id,amount\nx,1\n2,2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sr.Read(); err == nil || !strings.HasPrefix(err.Error(), "row 2: field int ID invalid") {
+		t.Errorf("got %v", err)
+	}
+	if r, err := sr.Read(); err != nil || r.ID != 2 {
+		t.Errorf("got %v and %v, want reading to carry on after a bad row", r, err)
+	}
+}
+
+func TestStructReaderReuseRecord(t *testing.T) {
+	sr, err := NewStructReaderWithOptions[amountRow](strings.NewReader("id,amount\n1,2\n3,x\n"), Options{ReuseRecord: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := sr.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := sr.Record()
+	if got := strings.Join(record, ","); got != "1,2" {
+		t.Errorf("record %q", got)
+	}
+
+	// the header is not overwritten by the reused record, so errors still
+	// name the right field
+	_, err = sr.Read()
+	if err == nil || err.Error() != `row 3: field float Amount invalid: invalid syntax, cell "x"` {
+		t.Errorf("got %v", err)
+	}
+	if &sr.Record()[0] != &record[0] {
+		t.Error("record not reused")
+	}
+	if first != (amountRow{1, 2}) {
+		t.Errorf("earlier row changed to %v", first)
+	}
+}
+
+// readAll reads sr to the end, collecting the rows and the row errors
+func readAll[T any](t *testing.T, sr *StructReader[T]) ([]T, []string) {
+	t.Helper()
+	var rows []T
+	var errs []string
+	for {
+		row, fatal, err := sr.read()
+		if err == io.EOF {
+			return rows, errs
+		}
+		if fatal {
+			t.Fatal(err)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestStructReaderWithOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		opts Options
+		want []amountRow
+		errs []string
+	}{
+		{"PadShortRows", "id,amount\n1\n2,3\n", Options{PadShortRows: true}, []amountRow{{1, 0}, {2, 3}}, nil},
+		{"HeaderRow", "report,2024\nid,amount\n1,2\n", Options{HeaderRow: 1}, []amountRow{{1, 2}}, nil},
+		{"HeaderComma", "id;amount\n1,2\n", Options{HeaderComma: ';'}, []amountRow{{1, 2}}, nil},
+		{"StripCellBOM", "id,\ufeffamount\n\ufeff1,2\n", Options{StripCellBOM: true}, []amountRow{{1, 2}}, nil},
+		{"MaxRows", "id,amount\n1,2\n3,4\n5,6\n", Options{MaxRows: 1}, []amountRow{{1, 2}}, nil},
+		{"MaxRows skips errors", "id,amount\nx,2\n3,4\n5,6\n", Options{MaxRows: 1, OnError: func(int, error) bool { return true }}, []amountRow{{3, 4}}, nil},
+		{"StrictRowWidth", "id,amount\n1\n2,3\n", Options{PadShortRows: true, StrictRowWidth: true}, []amountRow{{2, 3}}, []string{"row 2 has 1 fields, header has 2"}},
+		{"trailing blank line", "id,amount\n1,2\n \n", Options{}, []amountRow{{1, 2}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr, err := NewStructReaderWithOptions[amountRow](strings.NewReader(tt.in), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, errs := readAll(t, sr)
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Errorf("got %v, want %v", rows, tt.want)
+			}
+			if !reflect.DeepEqual(errs, tt.errs) {
+				t.Errorf("got errors %q, want %q", errs, tt.errs)
+			}
+		})
+	}
+
+	var skipped []int
+	sr, err := NewStructReaderWithOptions[amountRow](strings.NewReader("id,amount\n1,2\nx,3\n4,5\n"), Options{OnError: func(row int, err error) bool {
+		skipped = append(skipped, row)
+		return true
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows, _ := readAll(t, sr); len(rows) != 2 || !reflect.DeepEqual(skipped, []int{3}) {
+		t.Errorf("got %v, skipped rows %v", rows, skipped)
+	}
+
+	events, err := NewStructReaderWithOptions[eventRow](strings.NewReader("name,at\na,2024-01-01\nb,2024-02-01\nc,2024-03-01\n"), Options{
+		TimeRangeField: "At",
+		TimeFrom:       time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC),
+		TimeTo:         time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows, _ := readAll(t, events); len(rows) != 1 || rows[0].Name != "b" {
+		t.Errorf("time range got %v", rows)
+	}
+
+	unexported, err := NewStructReaderWithOptions[unexportedRow](strings.NewReader("name\nada\n"), Options{RecoverPanics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unexported.Read(); err == nil || !strings.Contains(err.Error(), "row 2: panic during conversion") {
+		t.Errorf("RecoverPanics got %v", err)
+	}
+
+	if _, err := NewStructReaderWithOptions[excelRow](strings.NewReader("name,\nAnn,x\n"), Options{EmptyHeaders: EmptyHeaderError}); err == nil {
+		t.Error("empty header accepted with EmptyHeaderError")
+	}
+	if _, err := NewStructReaderWithOptions[amountRow](strings.NewReader("<html>"), Options{SniffContent: true}); !errors.Is(err, ErrNotCSV) {
+		t.Errorf("SniffContent got %v", err)
+	}
+	sr, err = NewStructReaderWithOptions[amountRow](strings.NewReader("id,amount\n1,"+strings.Repeat("2", 100)+"\n"), Options{MaxLineBytes: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sr.Read(); !errors.Is(err, ErrLineTooLong) {
+		t.Errorf("MaxLineBytes got %v", err)
+	}
+	for _, opts := range []Options{{VerifyChecksum: true}, {Continuation: func(prev, row []string) bool { return false }}, {TypeConsistencyCheck: true}} {
+		if _, err := NewStructReaderWithOptions[amountRow](strings.NewReader("id,amount\n1,2\n"), opts); err == nil || !strings.Contains(err.Error(), "not supported by StructReader") {
+			t.Errorf("got %v, want an unsupported option error", err)
+		}
+	}
+}
+
+func BenchmarkStructReader(b *testing.B) {
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("ReuseRecord=%t", reuse), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				sr, err := NewStructReaderWithOptions[amountRow](&rowStream{rows: 1000}, Options{ReuseRecord: reuse})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for {
+					if _, err := sr.Read(); err == io.EOF {
+						break
+					} else if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadSeq(t *testing.T) {
+	var got []amountRow
+	var errs []string
+	for row, err := range ReadSeq[amountRow](strings.NewReader("id,amount\n1,2\nx,3\n4,5\n")) {
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		got = append(got, row)
+	}
+	if want := []amountRow{{1, 2}, {4, 5}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(errs) != 1 || !strings.HasPrefix(errs[0], "row 3:") {
+		t.Errorf("got errors %q", errs)
+	}
+
+	// breaking stops reading, the rest of the stream is never generated
+	stream := &rowStream{rows: 200000}
+	n := 0
+	for _, err := range ReadSeq[amountRow](stream) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n++; n == 3 {
+			break
+		}
+	}
+	if stream.n > 1000 {
+		t.Errorf("read %d rows after stopping at 3", stream.n)
+	}
+
+	for _, err := range ReadSeq[amountRow](strings.NewReader("")) {
+		if !errors.Is(err, ErrNoHeader) {
+			t.Errorf("empty input got %v", err)
+		}
+	}
+}
+
+func TestReadFileSeq(t *testing.T) {
+	name := writeFile(t, "id,amount\n1,2\n3,4\n5,6\n")
+	var opened *os.File
+	orig := openFile
+	openFile = func(name string) (*os.File, error) {
+		f, err := orig(name)
+		opened = f
+		return f, err
+	}
+	t.Cleanup(func() { openFile = orig })
+
+	for row, err := range ReadFileSeq[amountRow](name) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row.ID != 1 {
+			t.Errorf("got %v", row)
+		}
+		break
+	}
+	if opened == nil {
+		t.Fatal("file not opened")
+	}
+	if err := opened.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("file still open after stopping early, Close gave %v", err)
+	}
+
+	failOpen(t, 1, fs.ErrNotExist)
+	for _, err := range ReadFileSeq[amountRow](name) {
+		if err == nil || !strings.Contains(err.Error(), "unable to read file") {
+			t.Errorf("got %v", err)
+		}
+	}
+}
+
+func TestReadSeqWithOptions(t *testing.T) {
+	var got []amountRow
+	for row, err := range ReadSeqWithOptions[amountRow](strings.NewReader("id;amount\n1;2\n3;4\n5;6\n"), Options{Comma: ';', ReuseRecord: true, MaxRows: 2}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row)
+	}
+	if want := []amountRow{{1, 2}, {3, 4}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	name := writeFile(t, "report\nid,amount\n1,2\n")
+	got = nil
+	for row, err := range ReadFileSeqWithOptions[amountRow](name, Options{HeaderRow: 1}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row)
+	}
+	if want := []amountRow{{1, 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("file got %v, want %v", got, want)
+	}
+}
+
+func TestReadSeqRestField(t *testing.T) {
+	var got []tailRow
+	for row, err := range ReadSeq[tailRow](strings.NewReader("id,values\na,1,2,3\nb,4\nc\n")) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row)
+	}
+	want := []tailRow{{"a", []string{"1", "2", "3"}}, {"b", []string{"4"}}, {"c", nil}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadSeqTrailingBlank(t *testing.T) {
+	type nameOnly struct {
+		Name string `col:"name"`
+	}
+	var got []nameOnly
+	for row, err := range ReadSeq[nameOnly](strings.NewReader("name\nAda\n \n")) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row)
+	}
+	if want := []nameOnly{{"Ada"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	sr, err := NewStructReader[excelRow](strings.NewReader("name,city\nAda,London\n \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows, _ := readAll(t, sr); !reflect.DeepEqual(rows, []excelRow{{"Ada", "London"}}) {
+		t.Errorf("two columns got %q", rows)
+	}
+}
@@ -0,0 +1,40 @@
+package csvutil
+
+import (
+	"reflect"
+)
+
+// FieldInfo describes one col tagged field of a struct
+type FieldInfo struct {
+	// Name is the Go field name
+	Name string
+	// Column is the header the field is read from and written to
+	Column string
+	// Type is the Go type of the field
+	Type reflect.Type
+	// Kind is Type.Kind(), eg. reflect.Int
+	Kind reflect.Kind
+	// Tag holds every tag on the field, eg. Tag.Get("enum")
+	Tag reflect.StructTag
+}
+
+// Schema lists the col tagged fields of T in field order, handy for
+// generating a data dictionary of a file layout
+func Schema[T any]() ([]FieldInfo, error) {
+	header, err := getStructTagForHeader[T]()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]FieldInfo, 0, len(header))
+	for _, fld := range header {
+		out = append(out, FieldInfo{
+			Name:   fld.Name,
+			Column: fld.Tag.Get("col"),
+			Type:   fld.Type,
+			Kind:   fld.Type.Kind(),
+			Tag:    fld.Tag,
+		})
+	}
+	return out, nil
+}
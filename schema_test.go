@@ -0,0 +1,37 @@
+package csvutil
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type schemaRow struct {
+	ID      int       `col:"id" required:"true"`
+	Name    string    `col:"name"`
+	Created time.Time `col:"created" time:"2006-01-02"`
+	Notes   string
+	Raw     string `col:"@raw"`
+}
+
+func TestSchema(t *testing.T) {
+	got, err := Schema[schemaRow]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FieldInfo{
+		{Name: "ID", Column: "id", Type: reflect.TypeOf(0), Kind: reflect.Int, Tag: `col:"id" required:"true"`},
+		{Name: "Name", Column: "name", Type: reflect.TypeOf(""), Kind: reflect.String, Tag: `col:"name"`},
+		{Name: "Created", Column: "created", Type: reflect.TypeOf(time.Time{}), Kind: reflect.Struct, Tag: `col:"created" time:"2006-01-02"`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got[0].Tag.Get("required") != "true" {
+		t.Error("required tag lost")
+	}
+
+	if _, err := Schema[int](); err == nil {
+		t.Error("schema of a non struct")
+	}
+}
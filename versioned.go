@@ -0,0 +1,52 @@
+package csvutil
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Same as ReadToStruct but the row type is picked from the header by selector,
+// for files whose layout changed over time. selector returns a zero value of
+// the struct to read, eg. V1{}, or nil when no layout matches. The result is a
+// []V1 or []V2 holding every row, told apart with a type switch
+// eg.
+//
+//	out, err := ReadVersioned("data.csv", func(header []string) any {
+//	    if slices.Contains(header, "email") {
+//	        return V2{}
+//	    }
+//	    return V1{}
+//	})
+//	switch rows := out.(type) {
+//	case []V1:
+//	case []V2:
+//	}
+func ReadVersioned(filename string, selector func(header []string) any) (any, error) {
+	records, err := readFileToArr(filename, Options{}, readState{})
+	if err != nil {
+		return nil, fmt.Errorf("read file error %w", err)
+	}
+	if len(records) == 0 {
+		return nil, ErrNoHeader
+	}
+
+	proto := selector(records[0])
+	if proto == nil {
+		return nil, fmt.Errorf("no schema matches header %v", records[0])
+	}
+	elem := reflect.TypeOf(proto)
+	conv, err := readColumnDef(elem, records[0], Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	out := reflect.MakeSlice(reflect.SliceOf(elem), 0, len(records)-1)
+	for i, r := range records[1:] {
+		v, err := conv(r)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", i+2, err)
+		}
+		out = reflect.Append(out, v.Elem())
+	}
+	return out.Interface(), nil
+}
@@ -0,0 +1,62 @@
+package csvutil
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type contactV1 struct {
+	Name string `col:"name"`
+}
+
+type contactV2 struct {
+	Name  string `col:"name"`
+	Email string `col:"email"`
+}
+
+func pickContact(header []string) any {
+	switch {
+	case slices.Contains(header, "email"):
+		return contactV2{}
+	case slices.Contains(header, "name"):
+		return contactV1{}
+	}
+	return nil
+}
+
+func TestReadVersioned(t *testing.T) {
+	out, err := ReadVersioned(writeFile(t, "name\nAda\n"), pickContact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []contactV1{{"Ada"}}; !reflect.DeepEqual(out, want) {
+		t.Errorf("v1 got %#v", out)
+	}
+
+	out, err = ReadVersioned(writeFile(t, "email,name\nada@example.com,Ada\n"), pickContact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []contactV2{{"Ada", "ada@example.com"}}; !reflect.DeepEqual(out, want) {
+		t.Errorf("v2 got %#v", out)
+	}
+}
+
+func TestReadVersionedErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"id\n1\n", "no schema matches header [id]"},
+		{"", ErrNoHeader.Error()},
+		{"name,email\nAda\n", "wrong number of fields"},
+	}
+	for _, tt := range tests {
+		_, err := ReadVersioned(writeFile(t, tt.content), pickContact)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.content, err, tt.want)
+		}
+	}
+}